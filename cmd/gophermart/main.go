@@ -1,44 +1,160 @@
 package main
 
 import (
-	"flag"
-	"fmt"
-	"github.com/caarlos0/env/v6"
-	"github.com/gorilla/sessions"
+	"context"
+	"errors"
 	"gophermart/internal/app"
 	"gophermart/internal/config"
-	"gophermart/internal/service"
+	"gophermart/internal/notifier"
+	"gophermart/internal/outbox"
 	"gophermart/internal/storage"
+	"gophermart/internal/webhook"
 	"log"
+	"os"
 	"time"
 )
 
 func main() {
-	var cfg config.Config
-	if err := env.Parse(&cfg); err != nil {
+	// gophermart config print [flags] shows the effective config with the secrets redacted
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		printConfig(os.Args[3:])
+		return
+	}
+
+	cfg, err := config.Load(os.Args[1:], os.Environ())
+	if err != nil {
 		log.Fatal(err)
 	}
-	flag.StringVar(&cfg.DatabaseDSN, "d", cfg.DatabaseDSN, "File Storage Path")
-	flag.StringVar(&cfg.ServerAddress, "a", cfg.ServerAddress, "Server address")
-	flag.StringVar(&cfg.AccrualAddress, "r", cfg.AccrualAddress, "Accrual address")
-	flag.Parse()
+	debug := cfg.LogLevel == "debug"
 
-	fmt.Println(cfg.DatabaseDSN)
+	userStorage := storage.NewUserStorage(cfg.DatabaseDSN, storage.Settings{
+		ResetTokenTTL:      cfg.ResetTokenTTL,
+		ResetRequestLimit:  cfg.ResetRequestLimit,
+		ResetRequestWindow: cfg.ResetRequestWindow,
 
-	userStorage := storage.NewUserStorage(cfg.DatabaseDSN)
-	cookieStorage := sessions.NewCookieStore([]byte(service.SecretKey))
-	var application = app.NewApp(cfg, userStorage, *cookieStorage)
+		AllowNegativeBalance: cfg.AllowNegativeBalance,
+		PointsExpiryMonths:   cfg.PointsExpiryMonths,
+		IdempotencyKeyTTL:    cfg.IdempotencyKeyTTL,
+		WithdrawalRules:      app.WithdrawalRules(cfg),
 
-	tickerUpdate := time.NewTicker(storage.UPDATEACCURALTIMER)
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		ConnMaxIdleTime: cfg.DBConnMaxIdleTime,
+		LogLevel:        cfg.LogLevel,
+	})
+	cookieStorage, err := app.NewCookieStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var application = app.NewApp(cfg, userStorage, *cookieStorage, notifier.New(cfg.NotifierFile))
+
+	// with the accrual system pushing the statuses the poller only picks up what a push missed
+	pollInterval := cfg.AccrualPollInterval
+	if cfg.AccrualPushSecret != "" {
+		pollInterval = cfg.AccrualFallbackPollInterval
+	}
+	tickerUpdate := time.NewTicker(pollInterval)
 	go func() {
 		for range tickerUpdate.C {
-			log.Printf("updating accural")
-			err := application.UpdateAccrual()
+			if debug {
+				log.Printf("updating accural")
+			}
+			err := application.UpdateAccrual(context.Background())
 			if err != nil {
 				log.Printf("update accural: %s", err)
 			}
 		}
 	}()
 
+	tickerReconcile := time.NewTicker(cfg.ReconcileInterval)
+	go func() {
+		for range tickerReconcile.C {
+			if debug {
+				log.Printf("reconciling accruals")
+			}
+			err := application.ReconcileAccruals(context.Background())
+			if err != nil {
+				log.Printf("reconcile accruals: %s", err)
+			}
+		}
+	}()
+
+	tickerExpiry := time.NewTicker(cfg.ExpiryInterval)
+	go func() {
+		for range tickerExpiry.C {
+			err := application.ExpirePoints(context.Background())
+			if err != nil {
+				log.Printf("expire points: %s", err)
+			}
+		}
+	}()
+
+	tickerIdempotency := time.NewTicker(cfg.IdempotencyCleanupInterval)
+	go func() {
+		for range tickerIdempotency.C {
+			err := application.DeleteExpiredIdempotencyKeys(context.Background())
+			if err != nil {
+				log.Printf("delete expired idempotency keys: %s", err)
+			}
+		}
+	}()
+
+	tickerRateLimit := time.NewTicker(cfg.RateLimitPeriod)
+	go func() {
+		for range tickerRateLimit.C {
+			err := application.DeleteStaleRateLimitBuckets(context.Background())
+			if err != nil {
+				log.Printf("delete stale rate limit buckets: %s", err)
+			}
+		}
+	}()
+
+	sink, err := outbox.NewSink(cfg.OutboxSink, cfg.OutboxSinkURL, cfg.OutboxSubject)
+	if err != nil {
+		log.Fatal(err)
+	}
+	relay := outbox.NewRelay(userStorage, sink, cfg.OutboxBatchSize)
+	tickerOutbox := time.NewTicker(cfg.OutboxRelayInterval)
+	go func() {
+		for range tickerOutbox.C {
+			err := relay.Relay(context.Background())
+			if err != nil {
+				log.Printf("relay outbox: %s", err)
+			}
+		}
+	}()
+
+	dispatcher := webhook.NewDispatcher(userStorage, webhook.Settings{
+		Timeout:     cfg.WebhookTimeout,
+		MaxAttempts: cfg.WebhookMaxAttempts,
+		Backoff:     cfg.WebhookBackoff,
+		MaxBackoff:  cfg.WebhookMaxBackoff,
+		BatchSize:   cfg.WebhookBatchSize,
+	})
+	tickerWebhook := time.NewTicker(cfg.WebhookInterval)
+	go func() {
+		for range tickerWebhook.C {
+			err := dispatcher.Dispatch(context.Background())
+			if err != nil {
+				log.Printf("dispatch webhooks: %s", err)
+			}
+		}
+	}()
+
 	application.Run()
 }
+
+func printConfig(args []string) {
+	cfg, err := config.Load(args, os.Environ())
+	var invalid config.Errors
+	if err != nil && !errors.As(err, &invalid) {
+		log.Fatal(err)
+	}
+	if printErr := cfg.Print(os.Stdout); printErr != nil {
+		log.Fatal(printErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package accrual
+
+import (
+	"sync"
+	"time"
+)
+
+// breaker opens after threshold consecutive failures. Once the cooldown is over a single probe
+// request is let through, it closes the circuit on success and opens it again on failure.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+func (breaker *breaker) allow() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.threshold <= 0 || breaker.failures < breaker.threshold {
+		return true
+	}
+	if breaker.probing || breaker.now().Before(breaker.openUntil) {
+		return false
+	}
+	breaker.probing = true
+	return true
+}
+
+func (breaker *breaker) record(ok bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.probing = false
+	if ok {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.threshold > 0 && breaker.failures >= breaker.threshold {
+		breaker.openUntil = breaker.now().Add(breaker.cooldown)
+	}
+}
@@ -0,0 +1,95 @@
+// Package accrual is the client of the accrual system that rates the orders.
+package accrual
+
+import (
+	"context"
+	"errors"
+	"gophermart/internal/service"
+	"sync"
+	"time"
+)
+
+// Kind is the outcome of an order request, the first four are the statuses of the accrual system.
+type Kind int
+
+const (
+	Registered Kind = iota + 1
+	Processing
+	Invalid
+	Processed
+	// Unknown orders are not registered in the accrual system (yet).
+	Unknown
+	// Throttled requests were refused by the accrual system, Result.RetryAfter tells when to come back.
+	Throttled
+)
+
+var kindNames = map[Kind]string{
+	Registered: "REGISTERED",
+	Processing: "PROCESSING",
+	Invalid:    "INVALID",
+	Processed:  "PROCESSED",
+	Unknown:    "UNKNOWN",
+	Throttled:  "THROTTLED",
+}
+
+// String is the order status of the kind in the accrual system.
+func (kind Kind) String() string {
+	return kindNames[kind]
+}
+
+type Result struct {
+	Kind       Kind
+	Accrual    float32
+	RetryAfter time.Duration
+}
+
+var (
+	ErrCircuitOpen      = errors.New("accrual system is unhealthy, requests are paused")
+	ErrUnexpectedStatus = errors.New("unexpected accrual system response")
+)
+
+// Client asks an accrual system about orders.
+type Client interface {
+	GetOrder(number service.OrderNumber, ctx context.Context) (Result, error)
+}
+
+// Clients hands out the client of the accrual system at an address.
+type Clients interface {
+	Client(address string) Client
+}
+
+type Settings struct {
+	// Timeout bounds a single attempt, the context bounds the request with its retries.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed attempt is repeated, after Backoff doubling each time.
+	MaxRetries int
+	Backoff    time.Duration
+	// RetryAfter is the pause after a 429 response without a Retry-After header.
+	RetryAfter time.Duration
+	// BreakerThreshold consecutive failed requests open the circuit for BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Pool keeps a client per accrual system address, so that every system has its own circuit breaker.
+type Pool struct {
+	settings Settings
+	mu       sync.Mutex
+	clients  map[string]*HTTPClient
+}
+
+func NewPool(settings Settings) *Pool {
+	return &Pool{settings: settings, clients: make(map[string]*HTTPClient)}
+}
+
+func (pool *Pool) Client(address string) Client {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	client, ok := pool.clients[address]
+	if !ok {
+		client = NewHTTPClient(address, pool.settings)
+		pool.clients[address] = client
+	}
+	return client
+}
@@ -0,0 +1,85 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient(t *testing.T) {
+	var failures int32 = 1
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/api/orders/79927398713":
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"order":"79927398713","status":"PROCESSED","accrual":500}`))
+		case "/api/orders/12345678903":
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/orders/4561261212345467":
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, Settings{Timeout: time.Second, MaxRetries: 2, Backoff: time.Millisecond})
+	ctx := context.Background()
+
+	result, err := client.GetOrder("79927398713", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Kind: Processed, Accrual: 500}, result, "5xx responses are retried")
+
+	result, err = client.GetOrder("12345678903", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Unknown, result.Kind)
+
+	result, err = client.GetOrder("4561261212345467", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Result{Kind: Throttled, RetryAfter: time.Minute}, result)
+
+	atomic.StoreInt32(&requests, 0)
+	result, err = client.GetOrder("79927398713", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Throttled, result.Kind)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests), "no requests are made while throttled")
+}
+
+func TestHTTPClientBreaker(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewHTTPClient(server.URL, Settings{Timeout: time.Second, BreakerThreshold: 2, BreakerCooldown: time.Minute})
+	now := time.Now()
+	client.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := client.GetOrder("79927398713", ctx)
+		assert.ErrorIs(t, err, ErrUnexpectedStatus)
+	}
+	_, err := client.GetOrder("79927398713", ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	now = now.Add(time.Minute)
+	_, err = client.GetOrder("79927398713", ctx)
+	assert.ErrorIs(t, err, ErrUnexpectedStatus, "a probe goes through after the cooldown")
+	_, err = client.GetOrder("79927398713", ctx)
+	assert.ErrorIs(t, err, ErrCircuitOpen, "a failed probe opens the circuit again")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
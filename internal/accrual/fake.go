@@ -0,0 +1,60 @@
+package accrual
+
+import (
+	"context"
+	"gophermart/internal/service"
+	"sync"
+)
+
+// Fake is an accrual system in memory for tests. Orders without a set result are Unknown,
+// and Err, when set, fails every request. It serves as the client of any address.
+type Fake struct {
+	mu       sync.Mutex
+	results  map[service.OrderNumber]Result
+	errs     map[service.OrderNumber]error
+	Err      error
+	Requests int
+}
+
+func NewFake() *Fake {
+	return &Fake{results: make(map[service.OrderNumber]Result), errs: make(map[service.OrderNumber]error)}
+}
+
+// Fail fails the requests of the order with err, a nil err clears the failure.
+func (fake *Fake) Fail(number service.OrderNumber, err error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if err == nil {
+		delete(fake.errs, number)
+		return
+	}
+	fake.errs[number] = err
+}
+
+func (fake *Fake) Set(number service.OrderNumber, result Result) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.results[number] = result
+}
+
+func (fake *Fake) GetOrder(number service.OrderNumber, _ context.Context) (Result, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.Requests++
+	if fake.Err != nil {
+		return Result{}, fake.Err
+	}
+	if err, ok := fake.errs[number]; ok {
+		return Result{}, err
+	}
+	result, ok := fake.results[number]
+	if !ok {
+		return Result{Kind: Unknown}, nil
+	}
+	return result, nil
+}
+
+func (fake *Fake) Client(string) Client {
+	return fake
+}
@@ -0,0 +1,114 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"gophermart/internal/service"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPClient talks to the accrual system over its HTTP API. Transport errors and 5xx responses
+// are retried and count as failures of the circuit breaker. After a 429 response the client
+// answers Throttled without a request until the Retry-After pause is over.
+type HTTPClient struct {
+	client   *resty.Client
+	settings Settings
+	breaker  *breaker
+
+	mu             sync.Mutex
+	throttledUntil time.Time
+}
+
+func NewHTTPClient(address string, settings Settings) *HTTPClient {
+	return &HTTPClient{
+		client:   resty.New().SetBaseURL(address).SetTimeout(settings.Timeout),
+		settings: settings,
+		breaker:  newBreaker(settings.BreakerThreshold, settings.BreakerCooldown),
+	}
+}
+
+func (client *HTTPClient) GetOrder(number service.OrderNumber, ctx context.Context) (Result, error) {
+	if retryAfter := client.throttled(); retryAfter > 0 {
+		return Result{Kind: Throttled, RetryAfter: retryAfter}, nil
+	}
+	if !client.breaker.allow() {
+		return Result{}, ErrCircuitOpen
+	}
+
+	backoff := client.settings.Backoff
+	for attempt := 0; ; attempt++ {
+		result, retry, err := client.getOrder(number, ctx)
+		if !retry || attempt >= client.settings.MaxRetries || ctx.Err() != nil {
+			client.breaker.record(!retry)
+			return result, err
+		}
+
+		select {
+		case <-ctx.Done():
+			client.breaker.record(false)
+			return Result{}, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// getOrder makes a single attempt and reports whether a failure is worth a retry.
+func (client *HTTPClient) getOrder(number service.OrderNumber, ctx context.Context) (Result, bool, error) {
+	resp, err := client.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		Get("/api/orders/" + number.String())
+	if err != nil {
+		return Result{}, true, err
+	}
+
+	switch status := resp.StatusCode(); {
+	case status == http.StatusOK:
+		var response service.AccrualResponse
+		err = json.Unmarshal(resp.Body(), &response)
+		if err != nil {
+			return Result{}, false, fmt.Errorf("json decode order accrual: %w", err)
+		}
+		for kind := Registered; kind <= Processed; kind++ {
+			if kind.String() == response.Status {
+				return Result{Kind: kind, Accrual: response.Accrual}, false, nil
+			}
+		}
+		return Result{}, false, fmt.Errorf("%w: order status %q", ErrUnexpectedStatus, response.Status)
+
+	case status == http.StatusNoContent:
+		return Result{Kind: Unknown}, false, nil
+
+	case status == http.StatusTooManyRequests:
+		retryAfter := client.settings.RetryAfter
+		if seconds, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		client.throttle(retryAfter)
+		return Result{Kind: Throttled, RetryAfter: retryAfter}, false, nil
+
+	case status >= http.StatusInternalServerError:
+		return Result{}, true, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status())
+
+	default:
+		return Result{}, false, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status())
+	}
+}
+
+func (client *HTTPClient) throttle(retryAfter time.Duration) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.throttledUntil = time.Now().Add(retryAfter)
+}
+
+func (client *HTTPClient) throttled() time.Duration {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return time.Until(client.throttledUntil)
+}
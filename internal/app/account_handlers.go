@@ -0,0 +1,168 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"net/http"
+)
+
+func (app *App) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	var update service.ProfileUpdate
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		log.Printf("update profile: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if update.Login != nil {
+		err = service.CheckLogin(*update.Login)
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	profile, err := app.userStorage.UpdateProfile(login, update, r.Context())
+	if err != nil {
+		log.Printf("update profile: %s for user: %s", err, login)
+		if errors.Is(err, storage.ErrUserExists) {
+			http.Error(w, fmt.Sprint(err), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	if profile.Login != login {
+		session.Values["login"] = profile.Login
+		session.Save(r, w)
+	}
+	render.JSON(w, r, profile)
+}
+
+func (app *App) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	var change service.PasswordChange
+	err := json.NewDecoder(r.Body).Decode(&change)
+	if err != nil {
+		log.Printf("change password: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	err = service.CheckPassword(change.NewPassword)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		return
+	}
+
+	sessionVersion, err := app.userStorage.ChangePassword(login, change, r.Context())
+	if err != nil {
+		log.Printf("change password: %s for user: %s", err, login)
+		if errors.Is(err, storage.ErrInvalidCredentials) {
+			http.Error(w, fmt.Sprint(err), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	// the version bump logs out every other session, the current one is kept alive
+	session.Values["session_version"] = sessionVersion
+	session.Save(r, w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (app *App) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	err := app.userStorage.DeleteUser(login, r.Context())
+	if err != nil {
+		log.Printf("delete user: %s for user: %s", err, login)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	session.Options.MaxAge = -1
+	session.Save(r, w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (app *App) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var request service.PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf("forgot password: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	token, tokenHash, err := service.GenerateResetToken()
+	if err != nil {
+		log.Printf("forgot password: generate token: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.userStorage.CreatePasswordResetToken(request.Login, tokenHash, r.Context())
+	if err != nil {
+		log.Printf("forgot password: %s for user: %s", err, request.Login)
+		// unknown logins and the requests over the limit get the same answer as the accepted ones,
+		// so the endpoint can't be used to probe accounts
+		if errors.Is(err, storage.ErrUserNotFound) || errors.Is(err, storage.ErrTooManyResetRequests) {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.notifier.Notify(request.Login, "password reset",
+		fmt.Sprintf("use token %s to reset your password, it expires in %s", token, app.config.ResetTokenTTL))
+	if err != nil {
+		log.Printf("forgot password: notify: %s for user: %s", err, request.Login)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (app *App) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var reset service.PasswordReset
+	err := json.NewDecoder(r.Body).Decode(&reset)
+	if err != nil {
+		log.Printf("reset password: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	err = service.CheckPassword(reset.Password)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		return
+	}
+
+	err = app.userStorage.ResetPassword(service.HashResetToken(reset.Token), reset.Password, r.Context())
+	if err != nil {
+		log.Printf("reset password: %s", err)
+		if errors.Is(err, storage.ErrInvalidResetToken) {
+			http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"gophermart/internal/webhook"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IsAccrualSystem lets through requests signed like the outgoing webhooks: X-Accrual-Signature is
+// "sha256=" and the HMAC of "<X-Accrual-Timestamp>.<tenant id>.<body>" with the push secret of the
+// tenant, or with the configured one when the tenant has none, and the timestamp is within the
+// tolerance. The tenant is signed, so a push cannot be redirected to another tenant by its header
+// or host. The push endpoint is disabled when there is no secret.
+func (app *App) IsAccrualSystem(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := tenant(r.Context()).AccrualPushSecret
+		if secret == "" {
+			secret = app.config.AccrualPushSecret
+		}
+		if secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		timestamp := r.Header.Get("X-Accrual-Timestamp")
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, "accrual timestamp required", http.StatusUnauthorized)
+			return
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age > app.config.AccrualPushTolerance ||
+			age < -app.config.AccrualPushTolerance {
+			http.Error(w, "accrual timestamp is out of tolerance", http.StatusUnauthorized)
+			return
+		}
+		signature := "sha256=" + signAccrualPush(secret, timestamp, tenantID(r.Context()), body)
+		if !hmac.Equal([]byte(signature), []byte(r.Header.Get("X-Accrual-Signature"))) {
+			http.Error(w, "accrual signature is invalid", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func signAccrualPush(secret string, timestamp string, tenantID string, body []byte) string {
+	return webhook.Sign(secret, timestamp+"."+tenantID, body)
+}
+
+// handleAccrualPush takes the order statuses pushed by the accrual system, one or a JSON array of
+// them, and saves them the way the poller does, so a status pushed and polled is credited once.
+// A status that would move the order back, like REGISTERED after PROCESSING, is refused as stale.
+func (app *App) handleAccrualPush(w http.ResponseWriter, r *http.Request) {
+	accruals, err := parseAccrualPush(r)
+	if err != nil {
+		log.Printf("accrual push: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		return
+	}
+	if len(accruals) == 0 {
+		http.Error(w, "accrual push is empty", http.StatusBadRequest)
+		return
+	}
+	if batchLimit := app.orderBatchLimit(r.Context()); len(accruals) > batchLimit {
+		http.Error(w, fmt.Sprintf("accrual push is limited to %d orders", batchLimit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]service.OrderUploadResult, 0, len(accruals))
+	for _, accrual := range accruals {
+		result := service.OrderUploadResult{Number: accrual.OrderID.String(), Result: storage.PushAccepted}
+		switch accrual.Status {
+		case storage.REGISTERED, storage.PROCESSING, storage.INVALID:
+			accrual.Accrual = 0
+		case storage.PROCESSED:
+		default:
+			result.Result = storage.PushInvalidStatus
+			results = append(results, result)
+			continue
+		}
+		if accrual.Accrual < 0 {
+			result.Result = storage.PushInvalidStatus
+			results = append(results, result)
+			continue
+		}
+
+		order, err := app.userStorage.GetOrder(accrual.OrderID, r.Context())
+		if errors.Is(err, storage.ErrOrderNotFound) {
+			result.Result = storage.PushOrderNotFound
+			results = append(results, result)
+			continue
+		}
+		if err == nil && storage.StatusRegresses(order.Status, accrual.Status) {
+			log.Printf("accrual push: stale status %s for order %s in %s", accrual.Status, order.Number, order.Status)
+			result.Result = storage.PushStaleStatus
+			results = append(results, result)
+			continue
+		}
+		if err == nil {
+			log.Printf("accrual for order %s pushed as %s", order.Number, accrual.Status)
+			err = app.userStorage.UpdateOrderStatus(service.Order{
+				TenantID: order.TenantID,
+				Number:   order.Number,
+				Login:    order.Login,
+				Status:   accrual.Status,
+				Accrual:  accrual.Accrual,
+			}, r.Context())
+		}
+		if err != nil {
+			log.Printf("accrual push: %s for order: %s", err, accrual.OrderID)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result)
+	}
+	render.JSON(w, r, results)
+}
+
+func parseAccrualPush(r *http.Request) ([]service.AccrualResponse, error) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	var accruals []service.AccrualResponse
+	if trimmed := bytes.TrimSpace(body); len(trimmed) != 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &accruals)
+	} else {
+		var accrual service.AccrualResponse
+		err = json.Unmarshal(body, &accrual)
+		accruals = append(accruals, accrual)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("json parse error: %s", err)
+	}
+	return accruals, nil
+}
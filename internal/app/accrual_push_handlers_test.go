@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/config"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"gophermart/internal/webhook"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsAccrualSystem(t *testing.T) {
+	body := `{"order":"79927398713","status":"PROCESSED","accrual":500}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name         string
+		secret       string
+		tenantSecret string
+		timestamp    string
+		signature    string
+		statusCode   int
+	}{
+		{name: "signed", secret: "rickroll", timestamp: now,
+			signature: "sha256=" + signAccrualPush("rickroll", now, "shop", []byte(body)), statusCode: http.StatusOK},
+		{name: "wrong secret", secret: "rickroll", timestamp: now,
+			signature:  "sha256=" + signAccrualPush("nevergonna", now, "shop", []byte(body)),
+			statusCode: http.StatusUnauthorized},
+		{name: "other tenant", secret: "rickroll", timestamp: now,
+			signature:  "sha256=" + signAccrualPush("rickroll", now, service.DefaultTenantID, []byte(body)),
+			statusCode: http.StatusUnauthorized},
+		{name: "without tenant", secret: "rickroll", timestamp: now,
+			signature: "sha256=" + webhook.Sign("rickroll", now, []byte(body)), statusCode: http.StatusUnauthorized},
+		{name: "stale", secret: "rickroll", timestamp: stale,
+			signature:  "sha256=" + signAccrualPush("rickroll", stale, "shop", []byte(body)),
+			statusCode: http.StatusUnauthorized},
+		{name: "tenant secret", secret: "rickroll", tenantSecret: "giveyouup", timestamp: now,
+			signature: "sha256=" + signAccrualPush("giveyouup", now, "shop", []byte(body)), statusCode: http.StatusOK},
+		{name: "config secret of tenant with own secret", secret: "rickroll", tenantSecret: "giveyouup", timestamp: now,
+			signature:  "sha256=" + signAccrualPush("rickroll", now, "shop", []byte(body)),
+			statusCode: http.StatusUnauthorized},
+		{name: "tenant secret only", tenantSecret: "giveyouup", timestamp: now,
+			signature: "sha256=" + signAccrualPush("giveyouup", now, "shop", []byte(body)), statusCode: http.StatusOK},
+		{name: "push disabled", timestamp: now,
+			signature: "sha256=" + signAccrualPush("", now, "shop", []byte(body)), statusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{config: config.Config{AccrualPushSecret: tt.secret, AccrualPushTolerance: 5 * time.Minute}}
+			handler := app.IsAccrualSystem(func(w http.ResponseWriter, r *http.Request) {
+				accruals, err := parseAccrualPush(r)
+				require.NoError(t, err)
+				assert.Equal(t, []service.AccrualResponse{{OrderID: "79927398713", Status: "PROCESSED", Accrual: 500}},
+					accruals, "the body is passed on")
+			})
+
+			request := httptest.NewRequest(http.MethodPost, "/api/internal/accruals", strings.NewReader(body))
+			request = request.WithContext(service.ContextWithTenant(request.Context(),
+				service.Tenant{ID: "shop", AccrualPushSecret: tt.tenantSecret}))
+			request.Header.Set("X-Accrual-Timestamp", tt.timestamp)
+			request.Header.Set("X-Accrual-Signature", tt.signature)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			assert.Equal(t, tt.statusCode, recorder.Code)
+		})
+	}
+}
+
+func TestParseAccrualPush(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/api/internal/accruals", strings.NewReader(`
+		[{"order":"79927398713","status":"PROCESSED","accrual":500},{"order":"12345678903","status":"INVALID"}]`))
+	accruals, err := parseAccrualPush(request)
+	require.NoError(t, err)
+	assert.Len(t, accruals, 2)
+	assert.Equal(t, "INVALID", accruals[1].Status)
+
+	request = httptest.NewRequest(http.MethodPost, "/api/internal/accruals", strings.NewReader(`{"order":`))
+	_, err = parseAccrualPush(request)
+	assert.Error(t, err)
+}
+
+func TestAccrualPushStaleStatus(t *testing.T) {
+	app, _ := newAccrualApp(t, config.Config{OrderBatchLimit: 10})
+	login, numbers := uploadOrders(t, app, 1)
+	ctx := service.ContextWithTenant(context.Background(), service.Tenant{ID: service.DefaultTenantID})
+
+	push := func(status string) []service.OrderUploadResult {
+		body := fmt.Sprintf(`{"order":"%s","status":"%s"}`, numbers[0], status)
+		request := httptest.NewRequest(http.MethodPost, "/api/internal/accruals", strings.NewReader(body))
+		recorder := httptest.NewRecorder()
+		app.handleAccrualPush(recorder, request.WithContext(ctx))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var results []service.OrderUploadResult
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+		return results
+	}
+
+	assert.Equal(t, storage.PushAccepted, push(storage.PROCESSING)[0].Result)
+	assert.Equal(t, storage.PushStaleStatus, push(storage.REGISTERED)[0].Result)
+
+	orders, err := app.userStorage.GetOrdersByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.PROCESSING, orders[0].Status, "a stale push does not move the order back")
+}
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/gorilla/mux"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// IsAdmin lets through requests carrying the configured admin token as a bearer token.
+// The admin API is disabled when no token is configured.
+func (app *App) IsAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if app.config.AdminToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(app.config.AdminToken)) != 1 {
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}
+}
+
+func (app *App) handleReverseWithdrawal(w http.ResponseWriter, r *http.Request) {
+	orderID, err := service.ParseOrderNumber(mux.Vars(r)["order"], app.orderNumberLimits(r.Context()))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("order number is invalid: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var reversal service.WithdrawalReversal
+	err = json.NewDecoder(r.Body).Decode(&reversal)
+	if err != nil {
+		log.Printf("reverse withdrawal: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(reversal.Reason) == "" {
+		http.Error(w, "reversal reason is required", http.StatusBadRequest)
+		return
+	}
+
+	withdrawal, err := app.userStorage.ReverseWithdrawal(orderID, reversal.Reason, r.Context())
+	if err != nil {
+		log.Printf("reverse withdrawal: %s for order: %s", err, orderID)
+		if errors.Is(err, storage.ErrWithdrawalNotFound) {
+			http.Error(w, fmt.Sprint(err), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrAlreadyReversed) {
+			http.Error(w, fmt.Sprint(err), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("withdrawal for order %s reversed: %s", orderID, reversal.Reason)
+	render.JSON(w, r, withdrawal)
+}
@@ -1,12 +1,19 @@
 package app
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"gophermart/internal/accrual"
+	"gophermart/internal/broker"
 	"gophermart/internal/config"
+	"gophermart/internal/notifier"
+	"gophermart/internal/ratelimit"
 	"gophermart/internal/storage"
 	"gophermart/internal/tools"
 	"log"
+	"net"
 	"net/http"
 )
 
@@ -18,31 +25,140 @@ import (
    GET /api/user/balance — получение текущего баланса счёта баллов лояльности пользователя;
    POST /api/user/balance/withdraw — запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа;
    GET /api/user/balance/withdrawals — получение информации о выводе средств с накопительного счёта пользователем.
+   PATCH /api/user/profile — изменение имени и логина пользователя;
+   POST /api/user/password — смена пароля с завершением остальных сессий;
+   DELETE /api/user — удаление (анонимизация) аккаунта с сохранением истории заказов и списаний;
+   POST /api/user/password/forgot — запрос одноразового токена для сброса пароля;
+   POST /api/user/password/reset — установка нового пароля по токену;
+   POST /api/user/orders/batch — пакетная загрузка номеров заказов с результатом по каждому номеру;
+   GET /api/user/orders/stream — поток изменений статусов заказов и баланса (Server-Sent Events);
+   GET /api/user/balance/history — история движения баллов: начисления, списания, возвраты, корректировки и сгорания;
+   POST /api/admin/withdrawals/{order}/reverse — отмена списания с возвратом баллов (для поддержки);
+   POST, GET /api/admin/webhooks, DELETE /api/admin/webhooks/{id} — управление подписками на вебхуки;
+   GET /api/admin/webhooks/{id}/deliveries — журнал доставок вебхука;
+   GET /api/admin/webhooks/dead-letters, POST /api/admin/webhooks/dead-letters/{id}/retry — недоставленные вебхуки;
+   POST, GET /api/admin/tenants — управление магазинами (тенантами): хост, адрес системы начислений и правила;
+   POST /api/internal/accruals — приём статусов заказов от системы начислений (подпись HMAC вместе с магазином запроса,
+   секретом магазина или общим ACCRUAL_PUSH_SECRET), опрос остаётся резервом; статус, откатывающий заказ назад, отклоняется.
+
+   Магазин запроса определяется заголовком X-Tenant-ID или хостом, по умолчанию — магазин "default".
+   Заказы, неизвестные системе начислений дольше ACCRUAL_UNKNOWN_MAX_AGE, становятся INVALID с причиной в поле reason.
+   Запросы ограничиваются по IP и по пользователю, при превышении лимита ответ 429 с заголовками Retry-After и RateLimit-*.
+   IP клиента берётся из X-Forwarded-For, только если запрос пришёл от прокси из сетей TRUSTED_PROXIES.
 */
 
 type App struct {
-	config        config.Config
-	userStorage   storage.UserStorage
-	cookieStorage sessions.CookieStore
+	config         config.Config
+	userStorage    storage.UserStorage
+	cookieStorage  sessions.CookieStore
+	notifier       notifier.Notifier
+	broker         *broker.Broker
+	limiter        ratelimit.Limiter
+	trustedProxies []*net.IPNet
+	accrual        accrual.Clients
 }
 
-func NewApp(cfg config.Config, userStorage storage.UserStorage, cookieStorage sessions.CookieStore) *App {
-	return &App{config: cfg, userStorage: userStorage, cookieStorage: cookieStorage}
+func NewApp(cfg config.Config, userStorage storage.UserStorage, cookieStorage sessions.CookieStore,
+	notifier notifier.Notifier) *App {
+	app := &App{
+		config:         cfg,
+		userStorage:    userStorage,
+		cookieStorage:  cookieStorage,
+		notifier:       notifier,
+		broker:         broker.New(),
+		trustedProxies: parseTrustedProxies(cfg.TrustedProxies),
+		accrual: accrual.NewPool(accrual.Settings{
+			Timeout:          cfg.AccrualTimeout,
+			MaxRetries:       cfg.AccrualMaxRetries,
+			Backoff:          cfg.AccrualRetryBackoff,
+			RetryAfter:       cfg.AccrualRetryAfter,
+			BreakerThreshold: cfg.AccrualBreakerThreshold,
+			BreakerCooldown:  cfg.AccrualBreakerCooldown,
+		}),
+	}
+	switch cfg.RateLimitBackend {
+	case "memory":
+		app.limiter = ratelimit.NewMemory()
+	case "postgres":
+		app.limiter = ratelimit.NewShared(userStorage)
+	}
+	return app
 }
 
 func (app *App) Run() {
+	var tlsConfig *tls.Config
+	if app.config.TLSCertFile != "" {
+		reloader, err := tools.NewCertReloader(app.config.TLSCertFile, app.config.TLSKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+
+	go app.broker.Listen(context.Background(), app.userStorage)
+	if app.config.GRPCAddress != "" {
+		go app.RunGRPC(tlsConfig)
+	}
+
 	router := mux.NewRouter()
-	router.Use(tools.GzipMiddleware, app.AddContext)
+	router.Use(tools.SecurityHeaders(app.config.HSTSMaxAge), tools.GzipMiddleware)
+
+	// streams live as long as the client stays, so they are not under the request timeout
+	stream := router.NewRoute().Subrouter()
+	stream.Use(app.ResolveTenant)
+	stream.HandleFunc("/api/user/orders/stream", app.IsAuthorized(app.handleOrdersStream)).Methods(http.MethodGet)
+
+	// the accrual system is authenticated by its signature and is not limited like the clients
+	internal := router.NewRoute().Subrouter()
+	internal.Use(app.AddContext, app.ResolveTenant, app.LimitBody)
+	internal.HandleFunc("/api/internal/accruals", app.IsAccrualSystem(app.handleAccrualPush)).Methods(http.MethodPost)
+
+	api := router.NewRoute().Subrouter()
+	api.Use(app.AddContext, app.ResolveTenant, app.RateLimit, app.LimitBody)
+
+	api.HandleFunc("/api/user/register", app.handleRegister).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/login", app.handleLogin).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/orders", app.IsAuthorized(app.Idempotent(app.handleUploadOrder))).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/orders", app.IsAuthorized(app.handleGetOrders)).Methods(http.MethodGet)
+	api.HandleFunc("/api/user/orders/batch", app.IsAuthorized(app.Idempotent(app.handleUploadOrderBatch))).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/balance", app.IsAuthorized(app.handleGetBalance)).Methods(http.MethodGet)
+	api.HandleFunc("/api/user/balance/withdraw", app.IsAuthorized(app.Idempotent(app.handleWithdraw))).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/balance/history", app.IsAuthorized(app.handleBalanceHistory)).Methods(http.MethodGet)
+	api.HandleFunc("/api/user/withdrawals", app.IsAuthorized(app.handleWithdrawInfo)).Methods(http.MethodGet)
+	api.HandleFunc("/api/user/profile", app.IsAuthorized(app.Idempotent(app.handleUpdateProfile))).Methods(http.MethodPatch)
+	api.HandleFunc("/api/user/password", app.IsAuthorized(app.handleChangePassword)).Methods(http.MethodPost)
+	api.HandleFunc("/api/user", app.IsAuthorized(app.handleDeleteUser)).Methods(http.MethodDelete)
+	api.HandleFunc("/api/user/password/forgot", app.handleForgotPassword).Methods(http.MethodPost)
+	api.HandleFunc("/api/user/password/reset", app.handleResetPassword).Methods(http.MethodPost)
 
-	router.HandleFunc("/api/user/register", app.handleRegister).Methods(http.MethodPost)
-	router.HandleFunc("/api/user/login", app.handleLogin).Methods(http.MethodPost)
-	router.HandleFunc("/api/user/orders", app.IsAuthorized(app.handleUploadOrder)).Methods(http.MethodPost)
-	router.HandleFunc("/api/user/orders", app.IsAuthorized(app.handleGetOrders)).Methods(http.MethodGet)
-	router.HandleFunc("/api/user/balance", app.IsAuthorized(app.handleGetBalance)).Methods(http.MethodGet)
-	router.HandleFunc("/api/user/balance/withdraw", app.IsAuthorized(app.handleWithdraw)).Methods(http.MethodPost)
-	router.HandleFunc("/api/user/withdrawals", app.IsAuthorized(app.handleWithdrawInfo)).Methods(http.MethodGet)
+	api.HandleFunc("/api/admin/withdrawals/{order}/reverse", app.IsAdmin(app.handleReverseWithdrawal)).
+		Methods(http.MethodPost)
+	api.HandleFunc("/api/admin/tenants", app.IsAdmin(app.handleCreateTenant)).Methods(http.MethodPost)
+	api.HandleFunc("/api/admin/tenants", app.IsAdmin(app.handleGetTenants)).Methods(http.MethodGet)
+	api.HandleFunc("/api/admin/webhooks", app.IsAdmin(app.handleCreateWebhook)).Methods(http.MethodPost)
+	api.HandleFunc("/api/admin/webhooks", app.IsAdmin(app.handleGetWebhooks)).Methods(http.MethodGet)
+	api.HandleFunc("/api/admin/webhooks/dead-letters", app.IsAdmin(app.handleGetDeadWebhookDeliveries)).
+		Methods(http.MethodGet)
+	api.HandleFunc("/api/admin/webhooks/dead-letters/{id:[0-9]+}/retry", app.IsAdmin(app.handleRetryWebhookDelivery)).
+		Methods(http.MethodPost)
+	api.HandleFunc("/api/admin/webhooks/{id:[0-9]+}", app.IsAdmin(app.handleDeleteWebhook)).Methods(http.MethodDelete)
+	api.HandleFunc("/api/admin/webhooks/{id:[0-9]+}/deliveries", app.IsAdmin(app.handleGetWebhookAttempts)).
+		Methods(http.MethodGet)
 
 	router.HandleFunc("/", app.handleDefault)
 
-	log.Fatal(http.ListenAndServe(app.config.ServerAddress, router))
+	server := &http.Server{
+		Addr:              app.config.ServerAddress,
+		Handler:           router,
+		ReadTimeout:       app.config.ServerReadTimeout,
+		ReadHeaderTimeout: app.config.ServerReadHeaderTimeout,
+		WriteTimeout:      app.config.ServerWriteTimeout,
+		IdleTimeout:       app.config.ServerIdleTimeout,
+		TLSConfig:         tlsConfig,
+	}
+	if tlsConfig != nil {
+		// the certificate comes from TLSConfig, so that a renewed one is served without a restart
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
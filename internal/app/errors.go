@@ -0,0 +1,23 @@
+package app
+
+import (
+	"github.com/go-chi/render"
+	"net/http"
+)
+
+// Codes of the errors answered with an errorResponse.
+const (
+	codeOrderUsedForWithdrawal = "ORDER_USED_FOR_WITHDRAWAL"
+	codeOrderUsedForAccrual    = "ORDER_USED_FOR_ACCRUAL"
+)
+
+// errorResponse is the JSON body of the errors that clients tell apart by the code.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, statusCode int, code string, err error) {
+	render.Status(r, statusCode)
+	render.JSON(w, r, errorResponse{Code: code, Message: err.Error()})
+}
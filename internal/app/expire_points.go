@@ -0,0 +1,30 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ExpirePoints writes off the points whose lots expired and lets the owners know.
+func (app *App) ExpirePoints(ctx context.Context) error {
+	expired, err := app.userStorage.ExpirePoints(time.Now(), ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, expiry := range expired {
+		log.Printf("%f points of order %s expired for user %s, unrecovered %f",
+			expiry.Amount, expiry.OrderNumber, expiry.Login, expiry.Unrecovered)
+		if expiry.Amount <= 0 {
+			continue
+		}
+		err = app.notifier.Notify(expiry.Login, "points expired",
+			fmt.Sprintf("%.2f points credited for order %s have expired", expiry.Amount, expiry.OrderNumber))
+		if err != nil {
+			log.Printf("expire points: notify: %s for user: %s", err, expiry.Login)
+		}
+	}
+	return nil
+}
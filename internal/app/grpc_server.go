@@ -0,0 +1,281 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gophermart/internal/pb"
+	"gophermart/internal/policy"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+type loginContextKey struct{}
+
+// grpcServer serves the gRPC mirror of the user endpoints. Session tokens are encoded with the
+// codecs of the cookie store, so a token is interchangeable with the session.id cookie value.
+type grpcServer struct {
+	pb.UnimplementedGophermartServer
+	app *App
+}
+
+// publicMethods are the calls that do not require a session token.
+var publicMethods = map[string]bool{
+	pb.Gophermart_Register_FullMethodName: true,
+	pb.Gophermart_Login_FullMethodName:    true,
+}
+
+// RunGRPC serves the gRPC API, over TLS when the HTTP server is configured with it.
+func (app *App) RunGRPC(tlsConfig *tls.Config) {
+	listener, err := net.Listen("tcp", app.config.GRPCAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(app.authInterceptor)}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	pb.RegisterGophermartServer(server, &grpcServer{app: app})
+	log.Fatal(server.Serve(listener))
+}
+
+// authInterceptor applies the same request deadlines as the HTTP API, resolves the tenant from the
+// "x-tenant-id" metadata or the authority and the login from the "authorization" metadata.
+// Calls that fail after running out of their context end with DeadlineExceeded or Canceled.
+func (app *App) authInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	timeout := app.config.RequestTimeout
+	if publicMethods[info.FullMethod] {
+		timeout = app.config.AuthRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := app.authorize(ctx, req, info, handler)
+	if err != nil && ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return resp, err
+}
+
+func (app *App) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant, err := app.resolveTenant(firstValue(md.Get("x-tenant-id")), firstValue(md.Get(":authority")), ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrTenantNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	ctx = service.ContextWithTenant(ctx, tenant)
+
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 || !strings.HasPrefix(authorization[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "session token is required")
+	}
+
+	values := make(map[interface{}]interface{})
+	err = securecookie.DecodeMulti("session.id", strings.TrimPrefix(authorization[0], "Bearer "), &values,
+		app.cookieStorage.Codecs...)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "session token is invalid")
+	}
+
+	ok, err := app.checkSession(values, ctx)
+	if err != nil {
+		log.Printf("grpc authorization: get session version: %s for user: %v", err, values["login"])
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "session is revoked")
+	}
+	return handler(context.WithValue(ctx, loginContextKey{}, values["login"].(string)), req)
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (app *App) sessionToken(login string, ctx context.Context) (string, error) {
+	values := make(map[interface{}]interface{})
+	err := app.fillSession(values, login, ctx)
+	if err != nil {
+		return "", err
+	}
+	return securecookie.EncodeMulti("session.id", values, app.cookieStorage.Codecs...)
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *pb.Credentials) (*pb.Session, error) {
+	err := s.app.userStorage.RegisterUser(service.User{Login: req.Login, Password: req.Password}, ctx)
+	if err != nil {
+		log.Printf("grpc register err: %s for user: %s", err, req.Login)
+		if errors.Is(err, storage.ErrUserExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "register error: %s", err)
+		}
+		return nil, status.Errorf(codes.Internal, "register error: %s", err)
+	}
+	return s.Login(ctx, req)
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *pb.Credentials) (*pb.Session, error) {
+	err := s.app.userStorage.CheckUserAuth(service.Authentication{Login: req.Login, Password: req.Password}, ctx)
+	if err != nil {
+		log.Printf("grpc auth err: %s for user: %s", err, req.Login)
+		if errors.Is(err, storage.ErrInvalidCredentials) {
+			return nil, status.Errorf(codes.Unauthenticated, "auth error: %s", err)
+		}
+		return nil, status.Errorf(codes.Internal, "auth error: %s", err)
+	}
+
+	token, err := s.app.sessionToken(req.Login, ctx)
+	if err != nil {
+		log.Printf("grpc auth: start session: %s for user: %s", err, req.Login)
+		return nil, status.Errorf(codes.Internal, "auth error: %s", err)
+	}
+	return &pb.Session{Token: token}, nil
+}
+
+func (s *grpcServer) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	var order service.Order
+	var err error
+	order.Number, err = service.ParseOrderNumber(req.Number, s.app.orderNumberLimits(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "order number is invalid: %s", err)
+	}
+
+	order.Login = ctx.Value(loginContextKey{}).(string)
+	err = s.app.userStorage.PutOrder(order, ctx)
+	if err != nil {
+		log.Printf("grpc upload order: %s for user: %s, number: %s", err, order.Login, order.Number)
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			return &pb.UploadOrderResponse{Result: storage.UploadAlreadyUploaded}, nil
+		}
+		if errors.Is(err, storage.ErrUploadedByAnotherUser) || errors.Is(err, storage.ErrAlreadyWithdrawn) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.UploadOrderResponse{Result: storage.UploadAccepted}, nil
+}
+
+func (s *grpcServer) ListOrders(ctx context.Context, _ *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	login := ctx.Value(loginContextKey{}).(string)
+	orders, err := s.app.userStorage.GetOrdersByLogin(login, ctx)
+	if err != nil && !errors.Is(err, storage.ErrOrderListEmpty) {
+		log.Printf("grpc get orders: %s for user: %s", err, login)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListOrdersResponse{Orders: make([]*pb.Order, 0, len(orders))}
+	for _, order := range orders {
+		response.Orders = append(response.Orders, &pb.Order{
+			Number:     order.Number.String(),
+			Status:     order.Status,
+			Accrual:    order.Accrual,
+			UploadedAt: timestamppb.New(order.UploadedAt),
+			Reason:     order.StatusReason,
+		})
+	}
+	return response, nil
+}
+
+func (s *grpcServer) GetBalance(ctx context.Context, _ *pb.GetBalanceRequest) (*pb.Balance, error) {
+	login := ctx.Value(loginContextKey{}).(string)
+	balance, err := s.app.userStorage.GetBalanceSummary(login, ctx)
+	if err != nil {
+		log.Printf("grpc get balance: %s for user: %s", err, login)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	balance.ExpiringSoon, err = s.app.userStorage.GetExpiringPoints(login,
+		time.Now().Add(s.app.config.ExpiringSoonWindow), ctx)
+	if err != nil {
+		log.Printf("grpc get balance: get expiring points: %s for user: %s", err, login)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.Balance{
+		Current:        balance.Current,
+		Withdrawn:      balance.Withdrawn,
+		ExpiringSoon:   balance.ExpiringSoon,
+		Pending:        balance.Pending,
+		Available:      balance.Available,
+		LifetimeEarned: balance.LifetimeEarned,
+	}, nil
+}
+
+func (s *grpcServer) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	withdrawal := service.Withdrawal{
+		Login:      ctx.Value(loginContextKey{}).(string),
+		Amount:     req.Sum,
+		OrderValue: req.OrderValue,
+	}
+	var err error
+	withdrawal.OrderID, err = service.ParseOrderNumber(req.Order, s.app.orderNumberLimits(ctx))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "order number is invalid: %s", err)
+	}
+
+	var violation *policy.Violation
+	err = WithdrawalRules(s.app.config).CheckRequest(withdrawal.Amount, withdrawal.OrderValue)
+	if errors.As(err, &violation) {
+		return nil, status.Errorf(codes.InvalidArgument, "%s: %s", violation.Code, err)
+	}
+
+	err = s.app.userStorage.Withdraw(withdrawal, ctx)
+	if err != nil {
+		log.Printf("grpc withdraw: %s for user: %s amount: %f order: %s",
+			err, withdrawal.Login, withdrawal.Amount, withdrawal.OrderID)
+		if errors.Is(err, storage.ErrNotEnoughPoints) {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+		if errors.Is(err, storage.ErrAlreadyWithdrawn) || errors.Is(err, storage.ErrOrderNumberUploaded) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+		if errors.As(err, &violation) {
+			return nil, status.Errorf(codes.FailedPrecondition, "%s: %s", violation.Code, err)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.WithdrawResponse{}, nil
+}
+
+func (s *grpcServer) ListWithdrawals(ctx context.Context, _ *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	login := ctx.Value(loginContextKey{}).(string)
+	withdrawals, err := s.app.userStorage.GetWithdrawals(login, ctx)
+	if err != nil && !errors.Is(err, storage.ErrWithdrawListEmpty) {
+		log.Printf("grpc withdraw info: %s for user: %s", err, login)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListWithdrawalsResponse{Withdrawals: make([]*pb.Withdrawal, 0, len(withdrawals))}
+	for _, withdrawal := range withdrawals {
+		response.Withdrawals = append(response.Withdrawals, &pb.Withdrawal{
+			Order:       withdrawal.OrderID.String(),
+			Sum:         withdrawal.Amount,
+			ProcessedAt: timestamppb.New(withdrawal.ProcessedAt),
+			Status:      withdrawal.Status,
+		})
+	}
+	return response, nil
+}
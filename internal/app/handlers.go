@@ -6,13 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/go-chi/render"
-	"github.com/theplant/luhn"
+	"github.com/gorilla/mux"
+	"gophermart/internal/config"
+	"gophermart/internal/policy"
 	"gophermart/internal/service"
 	"gophermart/internal/storage"
 	"io"
 	"log"
 	"net/http"
-	"strconv"
+	"strings"
 	"time"
 )
 
@@ -29,8 +31,13 @@ GET /api/user/balance/withdrawals — получение информации о
 func (app *App) IsAuthorized(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		session, _ := app.cookieStorage.Get(r, "session.id")
-		authenticated := session.Values["authenticated"]
-		if authenticated != nil && authenticated != false {
+		ok, err := app.checkSession(session.Values, r.Context())
+		if err != nil {
+			log.Printf("authorization: get session version: %s for user: %v", err, session.Values["login"])
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		if ok {
 			handler.ServeHTTP(w, r)
 			return
 		}
@@ -39,15 +46,146 @@ func (app *App) IsAuthorized(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// checkSession reports whether the session values are authenticated for the tenant of the request
+// and still bound to the current session version of the user.
+func (app *App) checkSession(values map[interface{}]interface{}, ctx context.Context) (bool, error) {
+	authenticated := values["authenticated"]
+	if authenticated == nil || authenticated == false {
+		return false, nil
+	}
+
+	// a session of one tenant is not valid for the others, even where the login exists
+	if tenant, _ := values["tenant"].(string); tenant != tenantID(ctx) {
+		return false, nil
+	}
+
+	login, _ := values["login"].(string)
+	sessionVersion, _ := values["session_version"].(int)
+	currentVersion, err := app.userStorage.GetSessionVersion(login, ctx)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return currentVersion == sessionVersion, nil
+}
+
+// startSession marks the request session as authenticated for the login and binds it to the
+// current session version of the user, so that a password change can revoke it later.
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, login string) error {
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	err := app.fillSession(session.Values, login, r.Context())
+	if err != nil {
+		return err
+	}
+	return session.Save(r, w)
+}
+
+func (app *App) fillSession(values map[interface{}]interface{}, login string, ctx context.Context) error {
+	sessionVersion, err := app.userStorage.GetSessionVersion(login, ctx)
+	if err != nil {
+		return err
+	}
+
+	values["authenticated"] = true
+	values["tenant"] = tenantID(ctx)
+	values["login"] = login
+	values["session_version"] = sessionVersion
+	return nil
+}
+
+// AddContext bounds the request context with the deadline of the route. The context stays bound to
+// the client connection, so the work of a client that went away is canceled as well.
 func (app *App) AddContext(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		ctx, cancel := context.WithTimeout(r.Context(), app.requestTimeout(r))
 		defer cancel()
 		r = r.WithContext(ctx)
+		handler.ServeHTTP(&deadlineWriter{ResponseWriter: w, ctx: ctx}, r)
+	})
+}
+
+// routeTemplate is the path template of the route matched for the request.
+func routeTemplate(r *http.Request) string {
+	var path string
+	if route := mux.CurrentRoute(r); route != nil {
+		path, _ = route.GetPathTemplate()
+	}
+	return path
+}
+
+func (app *App) requestTimeout(r *http.Request) time.Duration {
+	switch routeTemplate(r) {
+	case "/api/user/register", "/api/user/login", "/api/user/password", "/api/user/password/reset":
+		return app.config.AuthRequestTimeout
+	case "/api/user/orders/batch", "/api/internal/accruals":
+		return app.config.BatchRequestTimeout
+	}
+	return app.config.RequestTimeout
+}
+
+// deadlineWriter answers the errors of a request that ran out of its context with 504 when the
+// deadline passed and with 503 when the request was canceled, instead of the status the handler
+// chose for the failed storage call.
+type deadlineWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (writer *deadlineWriter) WriteHeader(statusCode int) {
+	if statusCode >= http.StatusBadRequest {
+		switch writer.ctx.Err() {
+		case context.DeadlineExceeded:
+			log.Printf("request deadline exceeded, answering %d with %d", statusCode, http.StatusGatewayTimeout)
+			statusCode = http.StatusGatewayTimeout
+		case context.Canceled:
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	writer.ResponseWriter.WriteHeader(statusCode)
+}
+
+// LimitBody caps the request body at the limit of the route. Bodies that declare a larger length
+// are refused at once, the others fail with http.MaxBytesError when the handler reads past the limit.
+func (app *App) LimitBody(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := app.bodyLimit(r)
+		if limit <= 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > limit {
+			http.Error(w, fmt.Sprintf("request body is limited to %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 		handler.ServeHTTP(w, r)
 	})
 }
 
+// bodyLimit is the body limit of the matched route, zero means no limit.
+func (app *App) bodyLimit(r *http.Request) int64 {
+	switch routeTemplate(r) {
+	case "/api/user/orders":
+		return app.config.MaxOrderBodyBytes
+	case "/api/user/orders/batch", "/api/internal/accruals":
+		return app.config.MaxBatchBodyBytes
+	}
+	return app.config.MaxBodyBytes
+}
+
+// bodyError answers a failed body read, with 413 when the body is over the route limit.
+func bodyError(w http.ResponseWriter, err error) {
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		http.Error(w, fmt.Sprintf("request body is limited to %d bytes", maxBytesError.Limit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, fmt.Sprintf("read body error: %s", err), http.StatusBadRequest)
+}
+
 func (app *App) handleRegister(w http.ResponseWriter, r *http.Request) {
 	var user service.User
 	err := json.NewDecoder(r.Body).Decode(&user)
@@ -82,10 +220,12 @@ func (app *App) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, _ := app.cookieStorage.Get(r, "session.id")
-	session.Values["authenticated"] = true
-	session.Values["login"] = user.Login
-	session.Save(r, w)
+	err = app.startSession(w, r, user.Login)
+	if err != nil {
+		log.Printf("register: start session: %s for user: %s", err, user.Login)
+		http.Error(w, fmt.Sprintf("auth error: %s", err), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -109,10 +249,12 @@ func (app *App) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, _ := app.cookieStorage.Get(r, "session.id")
-	session.Values["authenticated"] = true
-	session.Values["login"] = authDetails.Login
-	session.Save(r, w)
+	err = app.startSession(w, r, authDetails.Login)
+	if err != nil {
+		log.Printf("auth: start session: %s for user: %s", err, authDetails.Login)
+		http.Error(w, fmt.Sprintf("auth error: %s", err), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -120,22 +262,20 @@ func (app *App) handleUploadOrder(w http.ResponseWriter, r *http.Request) {
 
 	value, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("upload order: json parse error: %s", err)
-		http.Error(w, "json parse error", http.StatusBadRequest)
+		log.Printf("upload order: read body error: %s", err)
+		bodyError(w, err)
 		return
 	}
 	defer r.Body.Close()
 
-	orderID, _ := strconv.Atoi(string(value))
-	if !luhn.Valid(orderID) {
-		log.Printf("upload order: order number %s is invalid", string(value))
-		http.Error(w, "order number is invalid", http.StatusUnprocessableEntity)
+	var order service.Order
+	order.Number, err = service.ParseOrderNumber(string(value), app.orderNumberLimits(r.Context()))
+	if err != nil {
+		log.Printf("upload order: order number %s is invalid: %s", string(value), err)
+		http.Error(w, fmt.Sprintf("order number is invalid: %s", err), http.StatusUnprocessableEntity)
 		return
 	}
 
-	var order service.Order
-	order.Number = fmt.Sprint(orderID)
-
 	session, _ := app.cookieStorage.Get(r, "session.id")
 	order.Login = session.Values["login"].(string)
 	err = app.userStorage.PutOrder(order, r.Context())
@@ -145,6 +285,8 @@ func (app *App) handleUploadOrder(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprint(err), http.StatusOK)
 		} else if errors.Is(err, storage.ErrUploadedByAnotherUser) {
 			http.Error(w, fmt.Sprint(err), http.StatusConflict)
+		} else if errors.Is(err, storage.ErrAlreadyWithdrawn) {
+			writeError(w, r, http.StatusConflict, codeOrderUsedForWithdrawal, err)
 		} else {
 			http.Error(w, fmt.Sprint(err), http.StatusUnprocessableEntity)
 		}
@@ -154,6 +296,130 @@ func (app *App) handleUploadOrder(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (app *App) handleUploadOrderBatch(w http.ResponseWriter, r *http.Request) {
+	numbers, err := parseOrderBatch(r)
+	if err != nil {
+		log.Printf("upload order batch: %s", err)
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			bodyError(w, err)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		return
+	}
+	if len(numbers) == 0 {
+		http.Error(w, "order batch is empty", http.StatusBadRequest)
+		return
+	}
+	if batchLimit := app.orderBatchLimit(r.Context()); len(numbers) > batchLimit {
+		http.Error(w, fmt.Sprintf("order batch is limited to %d numbers", batchLimit),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	parsedNumbers := make([]service.OrderNumber, len(numbers))
+	parseErrors := make([]error, len(numbers))
+	var validNumbers []service.OrderNumber
+	for i, number := range numbers {
+		parsedNumbers[i], parseErrors[i] = service.ParseOrderNumber(number, app.orderNumberLimits(r.Context()))
+		if parseErrors[i] == nil {
+			validNumbers = append(validNumbers, parsedNumbers[i])
+		}
+	}
+
+	var uploaded []service.OrderUploadResult
+	if len(validNumbers) != 0 {
+		uploaded, err = app.userStorage.PutOrders(login, validNumbers, r.Context())
+		if err != nil {
+			log.Printf("upload order batch: %s for user: %s", err, login)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	results := make([]service.OrderUploadResult, 0, len(numbers))
+	for i, number := range numbers {
+		if parseErrors[i] != nil {
+			results = append(results, service.OrderUploadResult{Number: number, Result: storage.UploadInvalidNumber})
+			continue
+		}
+		results = append(results, uploaded[0])
+		uploaded = uploaded[1:]
+	}
+	render.JSON(w, r, results)
+}
+
+// parseOrderBatch reads order numbers either from a JSON array or from a newline separated list.
+func parseOrderBatch(r *http.Request) ([]string, error) {
+	defer r.Body.Close()
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var values []interface{}
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		err := decoder.Decode(&values)
+		if err != nil {
+			return nil, fmt.Errorf("json parse error: %w", err)
+		}
+		numbers := make([]string, 0, len(values))
+		for _, value := range values {
+			numbers = append(numbers, fmt.Sprint(value))
+		}
+		return numbers, nil
+	}
+
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	var numbers []string
+	for _, line := range strings.Split(string(value), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers, nil
+}
+
+// orderNumberLimits are the order number rules of the request tenant, the config fills in the ones it does not set.
+func (app *App) orderNumberLimits(ctx context.Context) service.OrderNumberLimits {
+	limits := service.OrderNumberLimits{
+		MinLength: app.config.OrderNumberMinLength,
+		MaxLength: app.config.OrderNumberMaxLength,
+	}
+	tenant, _ := service.TenantFromContext(ctx)
+	if tenant.OrderNumberMinLength != 0 {
+		limits.MinLength = tenant.OrderNumberMinLength
+	}
+	if tenant.OrderNumberMaxLength != 0 {
+		limits.MaxLength = tenant.OrderNumberMaxLength
+	}
+	return limits
+}
+
+// WithdrawalRules are the withdrawal limits of the config.
+func WithdrawalRules(cfg config.Config) policy.WithdrawalRules {
+	return policy.WithdrawalRules{
+		MinAmount:     cfg.WithdrawalMinAmount,
+		MaxAmount:     cfg.WithdrawalMaxAmount,
+		DailyCap:      cfg.WithdrawalDailyCap,
+		MonthlyCap:    cfg.WithdrawalMonthlyCap,
+		MaxOrderShare: cfg.WithdrawalMaxOrderShare,
+	}
+}
+
+func (app *App) orderBatchLimit(ctx context.Context) int {
+	tenant, _ := service.TenantFromContext(ctx)
+	if tenant.OrderBatchLimit != 0 {
+		return tenant.OrderBatchLimit
+	}
+	return app.config.OrderBatchLimit
+}
+
 func (app *App) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 	var order service.Order
 
@@ -174,27 +440,43 @@ func (app *App) handleGetOrders(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *App) handleGetBalance(w http.ResponseWriter, r *http.Request) {
-	var balance service.Balance
 	session, _ := app.cookieStorage.Get(r, "session.id")
-	balance.Login = session.Values["login"].(string)
+	login := session.Values["login"].(string)
 
-	currentBalance, err := app.userStorage.GetBalanceByLogin(balance.Login, r.Context())
+	balance, err := app.userStorage.GetBalanceSummary(login, r.Context())
 	if err != nil {
-		log.Printf("handle withdraw: get balance: %s for user: %s", err, balance.Login)
+		log.Printf("get balance: %s for user: %s", err, login)
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
 	}
 
-	balance.Current = currentBalance
-	withdrawn, err := app.userStorage.GetWithdrawnAmount(balance.Login, r.Context())
+	balance.ExpiringSoon, err = app.userStorage.GetExpiringPoints(login,
+		time.Now().Add(app.config.ExpiringSoonWindow), r.Context())
 	if err != nil {
-		log.Printf("handle withdraw: get withdrawn amount: %s for user: %s", err, balance.Login)
+		log.Printf("get balance: get expiring points: %s for user: %s", err, login)
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
 	}
-
-	balance.Withdrawn = withdrawn
 	render.JSON(w, r, balance)
 }
 
+func (app *App) handleBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	history, err := app.userStorage.GetBalanceHistory(login, r.Context())
+	if err != nil {
+		log.Printf("balance history: %s for user: %s", err, login)
+		if errors.Is(err, storage.ErrHistoryEmpty) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, history)
+}
+
 func (app *App) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 	var withdrawal service.Withdrawal
 
@@ -208,10 +490,19 @@ func (app *App) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orderID, _ := strconv.Atoi(withdrawal.OrderID)
-	if !luhn.Valid(orderID) {
-		log.Printf("withdraw: order number %s is invalid", withdrawal.OrderID)
-		http.Error(w, "order number is invalid", http.StatusUnprocessableEntity)
+	withdrawal.OrderID, err = service.ParseOrderNumber(withdrawal.OrderID.String(), app.orderNumberLimits(r.Context()))
+	if err != nil {
+		log.Printf("withdraw: order number %s is invalid: %s", withdrawal.OrderID, err)
+		http.Error(w, fmt.Sprintf("order number is invalid: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var violation *policy.Violation
+	err = WithdrawalRules(app.config).CheckRequest(withdrawal.Amount, withdrawal.OrderValue)
+	if errors.As(err, &violation) {
+		log.Printf("withdraw: %s for user: %s amount: %f order: %s",
+			err, withdrawal.Login, withdrawal.Amount, withdrawal.OrderID)
+		writeError(w, r, http.StatusUnprocessableEntity, violation.Code, err)
 		return
 	}
 
@@ -223,6 +514,18 @@ func (app *App) handleWithdraw(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusPaymentRequired)
 			return
 		}
+		if errors.Is(err, storage.ErrAlreadyWithdrawn) {
+			writeError(w, r, http.StatusConflict, codeOrderUsedForWithdrawal, err)
+			return
+		}
+		if errors.Is(err, storage.ErrOrderNumberUploaded) {
+			writeError(w, r, http.StatusConflict, codeOrderUsedForAccrual, err)
+			return
+		}
+		if errors.As(err, &violation) {
+			writeError(w, r, http.StatusUnprocessableEntity, violation.Code, err)
+			return
+		}
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 	}
 }
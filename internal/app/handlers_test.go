@@ -0,0 +1,107 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/config"
+	"gophermart/internal/tools"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitBody(t *testing.T) {
+	app := &App{config: config.Config{MaxBodyBytes: 64, MaxOrderBodyBytes: 8, MaxBatchBodyBytes: 32}}
+	read := func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	router := mux.NewRouter()
+	router.Use(tools.GzipMiddleware, app.LimitBody)
+	router.HandleFunc("/api/user/orders", read)
+	router.HandleFunc("/api/user/orders/batch", read)
+	router.HandleFunc("/api/user/profile", read)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(strings.Repeat("0", 1024)))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	tests := []struct {
+		name       string
+		path       string
+		body       io.Reader
+		gzip       bool
+		statusCode int
+	}{
+		{name: "order within limit", path: "/api/user/orders", body: strings.NewReader("12345678"), statusCode: http.StatusOK},
+		{name: "order over limit", path: "/api/user/orders", body: strings.NewReader("123456789"),
+			statusCode: http.StatusRequestEntityTooLarge},
+		{name: "batch has its own limit", path: "/api/user/orders/batch", body: strings.NewReader(strings.Repeat("1", 32)),
+			statusCode: http.StatusOK},
+		{name: "default limit", path: "/api/user/profile", body: strings.NewReader(strings.Repeat("1", 65)),
+			statusCode: http.StatusRequestEntityTooLarge},
+		{name: "unknown length", path: "/api/user/profile", body: io.MultiReader(strings.NewReader(strings.Repeat("1", 65))),
+			statusCode: http.StatusRequestEntityTooLarge},
+		{name: "limit applies after decompression", path: "/api/user/profile", body: bytes.NewReader(compressed.Bytes()),
+			gzip: true, statusCode: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.path, tt.body)
+			if tt.gzip {
+				request.Header.Set("Accept-Encoding", "gzip")
+				request.Header.Set("Content-Encoding", "gzip")
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			assert.Equal(t, tt.statusCode, recorder.Code)
+		})
+	}
+}
+
+func TestAddContext(t *testing.T) {
+	app := &App{config: config.Config{
+		RequestTimeout:      10 * time.Millisecond,
+		AuthRequestTimeout:  time.Second,
+		BatchRequestTimeout: time.Second,
+	}}
+	wait := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			http.Error(w, r.Context().Err().Error(), http.StatusInternalServerError)
+		case <-time.After(100 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+	router := mux.NewRouter()
+	router.Use(app.AddContext)
+	router.HandleFunc("/api/user/balance", wait)
+	router.HandleFunc("/api/user/login", wait)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/user/balance", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/user/login", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code, "auth routes have their own deadline")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/user/login", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "the request context is kept")
+}
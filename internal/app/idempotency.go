@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"gophermart/internal/service"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	recorder.statusCode = statusCode
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *responseRecorder) Write(b []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	recorder.body.Write(b)
+	return recorder.ResponseWriter.Write(b)
+}
+
+// Idempotent makes a mutating handler safe to retry: a request repeating the Idempotency-Key
+// of an earlier one gets the stored response instead of being executed again, and reusing
+// a key for a different request is rejected. Requests without the header pass through.
+func (app *App) Idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		session, _ := app.cookieStorage.Get(r, "session.id")
+		login := session.Values["login"].(string)
+
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		fingerprint.Write(body)
+		record := service.IdempotencyKey{
+			TenantID:    tenantID(r.Context()),
+			Login:       login,
+			Key:         key,
+			Fingerprint: hex.EncodeToString(fingerprint.Sum(nil)),
+		}
+
+		stored, created, err := app.userStorage.ReserveIdempotencyKey(record, r.Context())
+		if err != nil {
+			log.Printf("idempotency: reserve key: %s for user: %s", err, login)
+			http.Error(w, "idempotency key error", http.StatusInternalServerError)
+			return
+		}
+		if !created {
+			switch {
+			case stored.Fingerprint != record.Fingerprint:
+				http.Error(w, "idempotency key is already used for another request", http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				http.Error(w, "request with this idempotency key is in progress", http.StatusConflict)
+			default:
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		handler.ServeHTTP(recorder, r)
+		if recorder.statusCode == 0 {
+			// a handler that writes nothing answers 200, like the withdrawal does
+			recorder.statusCode = http.StatusOK
+		}
+
+		// the request context may be already done, the outcome has to be stored anyway
+		ctx, cancel := context.WithTimeout(service.ContextWithTenant(context.Background(), tenant(r.Context())),
+			2*time.Second)
+		defer cancel()
+		if recorder.statusCode >= http.StatusInternalServerError {
+			err = app.userStorage.ReleaseIdempotencyKey(login, key, ctx)
+		} else {
+			record.StatusCode = recorder.statusCode
+			record.ContentType = recorder.Header().Get("Content-Type")
+			record.Body = recorder.body.Bytes()
+			err = app.userStorage.SaveIdempotentResponse(record, ctx)
+		}
+		if err != nil {
+			log.Printf("idempotency: store response: %s for user: %s", err, login)
+		}
+	}
+}
+
+// DeleteExpiredIdempotencyKeys drops responses that can no longer be replayed.
+func (app *App) DeleteExpiredIdempotencyKeys(ctx context.Context) error {
+	deleted, err := app.userStorage.DeleteExpiredIdempotencyKeys(time.Now().Add(-app.config.IdempotencyKeyTTL), ctx)
+	if err != nil {
+		return err
+	}
+	if deleted != 0 {
+		log.Printf("deleted %d expired idempotency keys", deleted)
+	}
+	return nil
+}
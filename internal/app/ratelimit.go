@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"gophermart/internal/ratelimit"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type rateLimitBucket struct {
+	key   string
+	limit ratelimit.Limit
+}
+
+// RateLimit takes a token from every bucket of the request and refuses it with 429 when one of
+// them is empty, then the tokens taken from the other buckets are given back, so that a refused
+// request does not use up the quotas. The RateLimit-* headers report the bucket closest to its
+// limit. A failing limiter lets the requests through, the API stays available when the limiter is not.
+func (app *App) RateLimit(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.limiter == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		var reported *ratelimit.Result
+		var taken []rateLimitBucket
+		for _, bucket := range app.rateLimitBuckets(r) {
+			result, err := app.limiter.Allow(bucket.key, bucket.limit, r.Context())
+			if err != nil {
+				log.Printf("rate limit: %s for key: %s", err, bucket.key)
+				continue
+			}
+			if reported == nil || !result.Allowed || result.Remaining < reported.Remaining {
+				reported = &result
+			}
+			if !result.Allowed {
+				break
+			}
+			taken = append(taken, bucket)
+		}
+		if reported == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		ratelimit.SetHeaders(w.Header(), *reported)
+		if !reported.Allowed {
+			for _, bucket := range taken {
+				if err := app.limiter.Refund(bucket.key, bucket.limit, r.Context()); err != nil {
+					log.Printf("rate limit: refund: %s for key: %s", err, bucket.key)
+				}
+			}
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitBuckets are the buckets of the client IP and, for a logged in user, of the login,
+// each with a route specific one next to it. The keys are per tenant.
+func (app *App) rateLimitBuckets(r *http.Request) []rateLimitBucket {
+	limit := func(requests int) ratelimit.Limit {
+		return ratelimit.Limit{Requests: requests, Period: app.config.RateLimitPeriod}
+	}
+	tenant := tenantID(r.Context())
+	ip := clientIP(r, app.trustedProxies)
+
+	buckets := []rateLimitBucket{{key: "ip:" + tenant + ":" + ip, limit: limit(app.config.RateLimitIPRequests)}}
+	route := routeTemplate(r)
+	switch route {
+	case "/api/user/register", "/api/user/login", "/api/user/password/forgot", "/api/user/password/reset":
+		buckets = append(buckets, rateLimitBucket{
+			key: "auth:" + tenant + ":" + ip, limit: limit(app.config.RateLimitAuthRequests),
+		})
+	}
+
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login, _ := session.Values["login"].(string)
+	if authenticated, _ := session.Values["authenticated"].(bool); !authenticated || login == "" {
+		return buckets
+	}
+	buckets = append(buckets, rateLimitBucket{
+		key: "user:" + tenant + ":" + login, limit: limit(app.config.RateLimitUserRequests),
+	})
+	if r.Method == http.MethodPost && (route == "/api/user/orders" || route == "/api/user/orders/batch") {
+		buckets = append(buckets, rateLimitBucket{
+			key: "order:" + tenant + ":" + login, limit: limit(app.config.RateLimitOrderRequests),
+		})
+	}
+	return buckets
+}
+
+// clientIP is the address of the peer, or the client address in X-Forwarded-For when the peer
+// is a trusted proxy. The header is read from the right, past the trusted proxies, since the
+// client can put any address on its left.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip, trustedProxies) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses TRUSTED_PROXIES, the config is validated before, so bad entries are skipped.
+func parseTrustedProxies(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// DeleteStaleRateLimitBuckets drops the shared buckets that are full again.
+func (app *App) DeleteStaleRateLimitBuckets(ctx context.Context) error {
+	if _, ok := app.limiter.(*ratelimit.Shared); !ok {
+		return nil
+	}
+	_, err := app.userStorage.DeleteStaleRateLimitBuckets(time.Now().Add(-app.config.RateLimitPeriod), ctx)
+	return err
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/config"
+	"gophermart/internal/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.Config{
+		RateLimitPeriod:        time.Minute,
+		RateLimitIPRequests:    3,
+		RateLimitUserRequests:  2,
+		RateLimitAuthRequests:  1,
+		RateLimitOrderRequests: 1,
+	}
+	cookieStorage, err := NewCookieStore(cfg)
+	require.NoError(t, err)
+	app := &App{config: cfg, cookieStorage: *cookieStorage, limiter: ratelimit.NewMemory()}
+
+	router := mux.NewRouter()
+	router.Use(app.RateLimit)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/api/user/login", ok)
+	router.HandleFunc("/api/user/balance", ok)
+	router.HandleFunc("/api/user/orders", ok)
+
+	session := httptest.NewRecorder()
+	sessionRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	userSession, _ := app.cookieStorage.Get(sessionRequest, "session.id")
+	userSession.Values["authenticated"] = true
+	userSession.Values["login"] = "nevergonna"
+	require.NoError(t, userSession.Save(sessionRequest, session))
+
+	send := func(method string, path string, remoteAddr string, loggedIn bool) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.RemoteAddr = remoteAddr
+		if loggedIn {
+			request.AddCookie(session.Result().Cookies()[0])
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/api/user/login", "10.0.0.1:1000", false).Code)
+	refused := send(http.MethodPost, "/api/user/login", "10.0.0.1:1001", false)
+	assert.Equal(t, http.StatusTooManyRequests, refused.Code, "auth routes have a tighter limit per IP")
+	assert.Equal(t, "60", refused.Header().Get("Retry-After"))
+	assert.Equal(t, "1", refused.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", refused.Header().Get("RateLimit-Remaining"))
+	allowed := send(http.MethodGet, "/api/user/balance", "10.0.0.1:1002", false)
+	assert.Equal(t, http.StatusOK, allowed.Code)
+	assert.Equal(t, "1", allowed.Header().Get("RateLimit-Remaining"), "a refused request gives its IP token back")
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, "/api/user/orders", "10.0.0.2:1000", true).Code)
+	assert.Equal(t, http.StatusTooManyRequests, send(http.MethodPost, "/api/user/orders", "10.0.0.3:1000", true).Code,
+		"order uploads are limited per user whatever the IP")
+	allowed = send(http.MethodGet, "/api/user/balance", "10.0.0.4:1000", false)
+	assert.Equal(t, http.StatusOK, allowed.Code)
+	assert.Equal(t, "2", allowed.Header().Get("RateLimit-Remaining"))
+}
+
+func TestClientIP(t *testing.T) {
+	trustedProxies := parseTrustedProxies([]string{"10.0.0.0/8", "fd00::/8"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1000", want: "192.0.2.1"},
+		{name: "untrusted peer", remoteAddr: "192.0.2.1:1000", forwarded: []string{"198.51.100.1"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy chain", remoteAddr: "10.0.0.1:1000", forwarded: []string{"198.51.100.1, 10.0.0.2"},
+			want: "198.51.100.1"},
+		{name: "spoofed by client", remoteAddr: "10.0.0.1:1000", forwarded: []string{"203.0.113.1, 198.51.100.1"},
+			want: "198.51.100.1"},
+		{name: "headers joined", remoteAddr: "[fd00::1]:1000", forwarded: []string{"203.0.113.1", "198.51.100.1"},
+			want: "198.51.100.1"},
+		{name: "garbage", remoteAddr: "10.0.0.1:1000", forwarded: []string{"unknown"}, want: "10.0.0.1"},
+		{name: "no header", remoteAddr: "10.0.0.1:1000", want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwarded {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			assert.Equal(t, tt.want, clientIP(request, trustedProxies))
+		})
+	}
+}
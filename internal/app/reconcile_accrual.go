@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gophermart/internal/accrual"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+)
+
+// ReconcileAccruals re-verifies a batch of processed orders against the accrual system,
+// since its algorithms may change, and charges back accruals that were lowered or revoked.
+func (app *App) ReconcileAccruals(ctx context.Context) error {
+	orders, err := app.userStorage.GetOrdersToReconcile(app.config.ReconcileBatchSize, ctx)
+	if err != nil {
+		return err
+	}
+	accrualAddresses, err := app.accrualAddresses(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		result, err := app.accrual.Client(accrualAddresses[order.TenantID]).GetOrder(order.Number, ctx)
+		if errors.Is(err, accrual.ErrCircuitOpen) {
+			continue
+		}
+		if err != nil {
+			log.Printf("reconcile: %s for order: %s", err, order.Number)
+			continue
+		}
+
+		switch result.Kind {
+		case accrual.Throttled:
+			return nil
+
+		case accrual.Invalid, accrual.Processed:
+			if result.Kind == accrual.Invalid {
+				result.Accrual = 0
+			}
+			if result.Accrual < order.Accrual {
+				err = app.chargeBack(order, result, ctx)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+		case accrual.Registered, accrual.Processing:
+			log.Printf("reconcile: order %s is %s in accrual system, skipping", order.Number, result.Kind)
+
+		case accrual.Unknown:
+			log.Printf("reconcile: order %s is unknown to accrual system", order.Number)
+		}
+
+		err = app.userStorage.MarkOrderReconciled(order.Number,
+			service.ContextWithTenant(ctx, service.Tenant{ID: order.TenantID}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) chargeBack(order service.Order, result accrual.Result, ctx context.Context) error {
+	chargeback, err := app.userStorage.ChargeBack(order.Number, result.Accrual, result.Kind.String(),
+		service.ContextWithTenant(ctx, service.Tenant{ID: order.TenantID}))
+	if err != nil {
+		if errors.Is(err, storage.ErrNothingToChargeBack) {
+			return nil
+		}
+		return err
+	}
+	log.Printf("accrual for order %s charged back by %f, unrecovered %f",
+		order.Number, chargeback.Amount, chargeback.Unrecovered)
+
+	err = app.notifier.Notify(chargeback.Login, "accrual revised",
+		fmt.Sprintf("accrual for order %s was revised by the accrual system, %.2f points were charged back",
+			order.Number, chargeback.Amount))
+	if err != nil {
+		log.Printf("chargeback: notify: %s for user: %s", err, chargeback.Login)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/accrual"
+	"gophermart/internal/broker"
+	"gophermart/internal/config"
+	"gophermart/internal/notifier"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"os"
+	"testing"
+	"time"
+)
+
+// newAccrualApp is an app on the DATABASE_URI database that polls the returned fake accrual system.
+func newAccrualApp(t *testing.T, cfg config.Config) (*App, *accrual.Fake) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := storage.NewUserStorage(databaseDSN, storage.Settings{})
+	t.Cleanup(userStorage.DeleteAll)
+
+	fake := accrual.NewFake()
+	return &App{
+		config:      cfg,
+		userStorage: userStorage,
+		notifier:    notifier.LogNotifier{},
+		broker:      broker.New(),
+		accrual:     fake,
+	}, fake
+}
+
+// uploadOrders registers a user and uploads count new orders for them.
+func uploadOrders(t *testing.T, app *App, count int) (string, []service.OrderNumber) {
+	ctx := service.ContextWithTenant(context.Background(), service.Tenant{ID: service.DefaultTenantID})
+	login := fmt.Sprintf("accrual-%d", time.Now().UnixNano())
+	require.NoError(t, app.userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+
+	var numbers []service.OrderNumber
+	for candidate := time.Now().UnixNano(); len(numbers) < count; candidate++ {
+		number := service.OrderNumber(fmt.Sprint(candidate))
+		if service.ValidLuhn(number.String()) {
+			require.NoError(t, app.userStorage.PutOrder(service.Order{Number: number, Login: login}, ctx))
+			numbers = append(numbers, number)
+		}
+	}
+	return login, numbers
+}
+
+func TestReconcileAccruals(t *testing.T) {
+	app, fake := newAccrualApp(t, config.Config{ReconcileBatchSize: 10})
+	ctx := context.Background()
+
+	login, numbers := uploadOrders(t, app, 3)
+	for _, number := range numbers {
+		fake.Set(number, accrual.Result{Kind: accrual.Processed, Accrual: 100})
+	}
+	require.NoError(t, app.UpdateAccrual(ctx))
+
+	fake.Set(numbers[0], accrual.Result{Kind: accrual.Processed, Accrual: 60})
+	fake.Set(numbers[1], accrual.Result{Kind: accrual.Invalid})
+	require.NoError(t, app.ReconcileAccruals(ctx))
+
+	balance, err := app.userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(300-40-100), balance, "a lowered accrual is debited, an invalid one is charged back")
+
+	orders, err := app.userStorage.GetOrdersByLogin(login, ctx)
+	require.NoError(t, err)
+	statuses := make(map[service.OrderNumber]service.Order)
+	for _, order := range orders {
+		statuses[order.Number] = order
+	}
+	assert.Equal(t, float32(60), statuses[numbers[0]].Accrual)
+	assert.Equal(t, storage.INVALID, statuses[numbers[1]].Status)
+	assert.Equal(t, float32(100), statuses[numbers[2]].Accrual)
+}
+
+func TestReconcileAccrualsContinuesOnError(t *testing.T) {
+	app, fake := newAccrualApp(t, config.Config{ReconcileBatchSize: 10})
+	ctx := context.Background()
+
+	login, numbers := uploadOrders(t, app, 2)
+	for _, number := range numbers {
+		fake.Set(number, accrual.Result{Kind: accrual.Processed, Accrual: 100})
+	}
+	require.NoError(t, app.UpdateAccrual(ctx))
+
+	for _, number := range numbers {
+		fake.Set(number, accrual.Result{Kind: accrual.Processed, Accrual: 50})
+		fake.Fail(number, errors.New("accrual system is down"))
+	}
+	fake.Fail(numbers[1], nil)
+	require.NoError(t, app.ReconcileAccruals(ctx))
+
+	balance, err := app.userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(200-50), balance, "the order after a failed one is reconciled")
+
+	fake.Fail(numbers[0], nil)
+	require.NoError(t, app.ReconcileAccruals(ctx))
+	balance, err = app.userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(100), balance, "the failed order is reconciled on the next run")
+}
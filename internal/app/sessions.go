@@ -0,0 +1,49 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gophermart/internal/config"
+	"log"
+	"net/http"
+)
+
+// NewCookieStore builds the session store from the configured key pairs. Without configured keys
+// it makes random ones, so every deployment has its own, but sessions end with the process.
+// Session cookies are kept from scripts and cross site requests, and from plain HTTP
+// when the server runs TLS or SESSION_COOKIE_SECURE is set for a TLS terminating proxy.
+func NewCookieStore(cfg config.Config) (*sessions.CookieStore, error) {
+	if len(cfg.SessionHashKeys) == 0 {
+		log.Printf("SESSION_HASH_KEYS are not set, sessions are signed with random keys and end on restart")
+		store := sessions.NewCookieStore(securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32))
+		setCookieOptions(store, cfg)
+		return store, nil
+	}
+
+	keyPairs := make([][]byte, 0, 2*len(cfg.SessionHashKeys))
+	for i, hashKey := range cfg.SessionHashKeys {
+		hash, err := base64.StdEncoding.DecodeString(hashKey)
+		if err != nil {
+			return nil, fmt.Errorf("session hash key %d: %w", i+1, err)
+		}
+		var block []byte
+		if i < len(cfg.SessionBlockKeys) {
+			block, err = base64.StdEncoding.DecodeString(cfg.SessionBlockKeys[i])
+			if err != nil {
+				return nil, fmt.Errorf("session block key %d: %w", i+1, err)
+			}
+		}
+		keyPairs = append(keyPairs, hash, block)
+	}
+	store := sessions.NewCookieStore(keyPairs...)
+	setCookieOptions(store, cfg)
+	return store, nil
+}
+
+func setCookieOptions(store *sessions.CookieStore, cfg config.Config) {
+	store.Options.HttpOnly = true
+	store.Options.Secure = cfg.SessionCookieSecure || cfg.TLSCertFile != ""
+	store.Options.SameSite = http.SameSiteLaxMode
+}
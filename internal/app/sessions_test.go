@@ -0,0 +1,64 @@
+package app
+
+import (
+	"encoding/base64"
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/config"
+	"net/http"
+	"testing"
+)
+
+func randomKey(length int) string {
+	return base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(length))
+}
+
+func TestCookieStoreRotation(t *testing.T) {
+	oldHash, oldBlock := randomKey(64), randomKey(32)
+	newHash, newBlock := randomKey(64), randomKey(32)
+
+	oldStore, err := NewCookieStore(config.Config{SessionHashKeys: []string{oldHash}, SessionBlockKeys: []string{oldBlock}})
+	require.NoError(t, err)
+	rotatedStore, err := NewCookieStore(config.Config{
+		SessionHashKeys:  []string{newHash, oldHash},
+		SessionBlockKeys: []string{newBlock, oldBlock},
+	})
+	require.NoError(t, err)
+	newStore, err := NewCookieStore(config.Config{SessionHashKeys: []string{newHash}, SessionBlockKeys: []string{newBlock}})
+	require.NoError(t, err)
+
+	values := map[interface{}]interface{}{"login": "nevergonna"}
+	issued, err := securecookie.EncodeMulti("session.id", values, oldStore.Codecs...)
+	require.NoError(t, err)
+
+	decoded := make(map[interface{}]interface{})
+	require.NoError(t, securecookie.DecodeMulti("session.id", issued, &decoded, rotatedStore.Codecs...),
+		"old keys still verify after a rotation")
+	assert.Equal(t, "nevergonna", decoded["login"])
+	assert.Error(t, securecookie.DecodeMulti("session.id", issued, &decoded, newStore.Codecs...),
+		"retired keys no longer verify")
+
+	reissued, err := securecookie.EncodeMulti("session.id", values, rotatedStore.Codecs...)
+	require.NoError(t, err)
+	assert.NoError(t, securecookie.DecodeMulti("session.id", reissued, &decoded, newStore.Codecs...),
+		"the new key signs")
+
+	signedOnly := securecookie.New(securecookie.GenerateRandomKey(64), nil)
+	raw, err := base64.URLEncoding.DecodeString(reissued)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "nevergonna", "cookies are encrypted")
+	assert.Error(t, signedOnly.Decode("session.id", reissued, &decoded))
+}
+
+func TestCookieStoreOptions(t *testing.T) {
+	store, err := NewCookieStore(config.Config{})
+	require.NoError(t, err)
+	assert.True(t, store.Options.HttpOnly)
+	assert.False(t, store.Options.Secure)
+	assert.Equal(t, http.SameSiteLaxMode, store.Options.SameSite)
+
+	store, err = NewCookieStore(config.Config{SessionCookieSecure: true})
+	require.NoError(t, err)
+	assert.True(t, store.Options.Secure)
+}
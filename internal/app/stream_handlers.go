@@ -0,0 +1,147 @@
+package app
+
+import (
+	"fmt"
+	"gophermart/internal/broker"
+	"gophermart/internal/service"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	streamHeartbeat    = 15 * time.Second
+	streamPollInterval = 5 * time.Second
+	streamBatchSize    = 100
+	// streamLookback is longer than any transaction that writes events, the events committed
+	// after events with higher ids are re-read within it.
+	streamLookback = time.Minute
+)
+
+var streamEventTypes = []string{
+	service.EventOrderUploaded,
+	service.EventOrderStatusChanged,
+	service.EventPointsCredited,
+	service.EventPointsWithdrawn,
+	service.EventWithdrawalReversed,
+	service.EventPointsChargedBack,
+	service.EventPointsExpired,
+}
+
+// streamCursor is the position of a stream. Outbox ids are taken before the commit, so besides
+// the events after the last sent id it reads the events of the lookback window it has not sent yet.
+type streamCursor struct {
+	lastID uint
+	sent   map[uint]time.Time
+}
+
+func newStreamCursor(lastID uint) *streamCursor {
+	return &streamCursor{lastID: lastID, sent: make(map[uint]time.Time)}
+}
+
+// window returns the start of the lookback window and the ids sent within it.
+func (cursor *streamCursor) window(now time.Time) (time.Time, []uint) {
+	since := now.Add(-streamLookback)
+	sent := make([]uint, 0, len(cursor.sent))
+	for id, createdAt := range cursor.sent {
+		if createdAt.Before(since) {
+			delete(cursor.sent, id)
+			continue
+		}
+		sent = append(sent, id)
+	}
+	return since, sent
+}
+
+func (cursor *streamCursor) advance(event service.OutboxEvent) {
+	cursor.sent[event.ID] = event.CreatedAt
+	if event.ID > cursor.lastID {
+		cursor.lastID = event.ID
+	}
+}
+
+// handleOrdersStream pushes order status and balance events of the user as Server-Sent Events.
+// Event ids are outbox ids, so a client reconnecting with Last-Event-ID gets what it missed.
+// Events of the lookback window may be sent again after a reconnect, clients tell them apart by id.
+func (app *App) handleOrdersStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := app.cookieStorage.Get(r, "session.id")
+	login := session.Values["login"].(string)
+
+	// subscribe before reading the position, so that nothing committed in between is missed
+	signal, unsubscribe := app.broker.Subscribe(broker.Key(tenantID(r.Context()), login))
+	defer unsubscribe()
+
+	var cursor *streamCursor
+	// a new stream starts at the current events, the ones already in the window are skipped on the first read
+	skip := false
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Last-Event-ID is invalid", http.StatusBadRequest)
+			return
+		}
+		cursor = newStreamCursor(uint(id))
+	} else {
+		id, err := app.userStorage.GetLastEventID(r.Context())
+		if err != nil {
+			log.Printf("orders stream: get last event id: %s for user: %s", err, login)
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		cursor = newStreamCursor(id)
+		skip = true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", streamPollInterval.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	poll := time.NewTicker(streamPollInterval)
+	defer poll.Stop()
+
+	for {
+		since, sent := cursor.window(time.Now())
+		events, err := app.userStorage.GetUserEvents(login, cursor.lastID, since, sent, streamEventTypes,
+			streamBatchSize, r.Context())
+		if err != nil {
+			log.Printf("orders stream: get events: %s for user: %s", err, login)
+			return
+		}
+		for _, event := range events {
+			if !skip || event.ID > cursor.lastID {
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Payload)
+			}
+			cursor.advance(event)
+		}
+		if len(events) != 0 {
+			flusher.Flush()
+		}
+		if len(events) == streamBatchSize {
+			continue
+		}
+		skip = false
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-signal:
+		case <-poll.C:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		}
+	}
+}
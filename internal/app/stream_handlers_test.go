@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"github.com/gorilla/securecookie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/broker"
+	"gophermart/internal/config"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventStorage serves the outbox events of the stream, the other methods are left unimplemented.
+type eventStorage struct {
+	storage.UserStorage
+	mu     sync.Mutex
+	events []service.OutboxEvent
+	reads  int
+}
+
+func (events *eventStorage) commit(event service.OutboxEvent) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	events.events = append(events.events, event)
+}
+
+func (events *eventStorage) readCount() int {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return events.reads
+}
+
+func (events *eventStorage) GetLastEventID(context.Context) (uint, error) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	var lastID uint
+	for _, event := range events.events {
+		if event.ID > lastID {
+			lastID = event.ID
+		}
+	}
+	return lastID, nil
+}
+
+func (events *eventStorage) GetUserEvents(_ string, afterID uint, since time.Time, exclude []uint, _ []string,
+	limit int, _ context.Context) ([]service.OutboxEvent, error) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	events.reads++
+
+	excluded := make(map[uint]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	var found []service.OutboxEvent
+	for _, event := range events.events {
+		if (event.ID > afterID || event.CreatedAt.After(since)) && !excluded[event.ID] && len(found) < limit {
+			found = append(found, event)
+		}
+	}
+	return found, nil
+}
+
+func TestOrdersStreamLateCommit(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		lastEventID string
+		ids         []string
+	}{
+		// event 4 is committed while the stream runs, after event 5 that has a higher id
+		{name: "new stream", ids: []string{"5", "4"}},
+		// the client may have missed an event of the window, so it gets the window again
+		{name: "reconnect", lastEventID: "3", ids: []string{"3", "5", "4"}},
+		{name: "reconnect before the window", lastEventID: "1", ids: []string{"2", "3", "5", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := &eventStorage{events: []service.OutboxEvent{
+				{ID: 2, Type: service.EventOrderUploaded, Payload: "{}", CreatedAt: now.Add(-time.Hour)},
+				{ID: 3, Type: service.EventOrderUploaded, Payload: "{}", CreatedAt: now},
+			}}
+			cookieStorage, err := NewCookieStore(config.Config{})
+			require.NoError(t, err)
+			app := &App{userStorage: events, cookieStorage: *cookieStorage, broker: broker.New()}
+
+			session, err := securecookie.EncodeMulti("session.id", map[interface{}]interface{}{"login": "nevergonna"},
+				cookieStorage.Codecs...)
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(service.ContextWithTenant(context.Background(),
+				service.Tenant{ID: service.DefaultTenantID}))
+			request := httptest.NewRequest(http.MethodGet, "/api/user/orders/stream", nil).WithContext(ctx)
+			request.AddCookie(&http.Cookie{Name: "session.id", Value: session})
+			if tt.lastEventID != "" {
+				request.Header.Set("Last-Event-ID", tt.lastEventID)
+			}
+			recorder := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				app.handleOrdersStream(recorder, request)
+			}()
+
+			require.Eventually(t, func() bool { return events.readCount() >= 1 }, time.Second, time.Millisecond)
+			events.commit(service.OutboxEvent{ID: 5, Type: service.EventPointsCredited, Payload: "{}", CreatedAt: now})
+			app.broker.Publish(broker.Key(service.DefaultTenantID, "nevergonna"))
+			require.Eventually(t, func() bool { return events.readCount() >= 2 }, time.Second, time.Millisecond)
+			events.commit(service.OutboxEvent{ID: 4, Type: service.EventPointsWithdrawn, Payload: "{}", CreatedAt: now})
+			app.broker.Publish(broker.Key(service.DefaultTenantID, "nevergonna"))
+			require.Eventually(t, func() bool { return events.readCount() >= 3 }, time.Second, time.Millisecond)
+			cancel()
+			<-done
+
+			var ids []string
+			for _, match := range regexp.MustCompile(`(?m)^id: (\d+)$`).FindAllStringSubmatch(recorder.Body.String(), -1) {
+				ids = append(ids, match[1])
+			}
+			assert.Equal(t, tt.ids, ids)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ResolveTenant binds the request to the tenant named by the X-Tenant-ID header or, without it,
+// to the tenant serving the request host. Requests of unknown hosts go to the default tenant.
+func (app *App) ResolveTenant(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := app.resolveTenant(r.Header.Get("X-Tenant-ID"), r.Host, r.Context())
+		if err != nil {
+			log.Printf("resolve tenant: %s for host: %s", err, r.Host)
+			if errors.Is(err, storage.ErrTenantNotFound) {
+				http.Error(w, fmt.Sprint(err), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(service.ContextWithTenant(r.Context(), tenant)))
+	})
+}
+
+func (app *App) resolveTenant(id string, host string, ctx context.Context) (service.Tenant, error) {
+	if id != "" {
+		return app.userStorage.GetTenant(id, ctx)
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	tenant, err := app.userStorage.GetTenantByHost(host, ctx)
+	if errors.Is(err, storage.ErrTenantNotFound) {
+		return app.userStorage.GetTenant(service.DefaultTenantID, ctx)
+	}
+	return tenant, err
+}
+
+// tenant is the tenant of a request that went through ResolveTenant.
+func tenant(ctx context.Context) service.Tenant {
+	tenant, _ := service.TenantFromContext(ctx)
+	return tenant
+}
+
+func tenantID(ctx context.Context) string {
+	return tenant(ctx).ID
+}
+
+func (app *App) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	var tenant service.Tenant
+	err := json.NewDecoder(r.Body).Decode(&tenant)
+	if err != nil {
+		log.Printf("create tenant: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if !tenantIDPattern.MatchString(tenant.ID) {
+		http.Error(w, "tenant id should be lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+	if tenant.AccrualAddress != "" {
+		endpoint, err := url.Parse(tenant.AccrualAddress)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			http.Error(w, "accrual address should be an absolute http(s) url", http.StatusBadRequest)
+			return
+		}
+	}
+	if tenant.OrderBatchLimit < 0 || tenant.OrderNumberMinLength < 0 || tenant.OrderNumberMaxLength < 0 ||
+		(tenant.OrderNumberMaxLength != 0 && tenant.OrderNumberMinLength > tenant.OrderNumberMaxLength) {
+		http.Error(w, "tenant limits are invalid", http.StatusBadRequest)
+		return
+	}
+
+	tenant, err = app.userStorage.CreateTenant(tenant, r.Context())
+	if err != nil {
+		log.Printf("create tenant: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, tenant)
+}
+
+func (app *App) handleGetTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := app.userStorage.GetTenants(r.Context())
+	if err != nil {
+		log.Printf("get tenants: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	for i := range tenants {
+		tenants[i].AccrualPushSecret = ""
+	}
+	render.JSON(w, r, tenants)
+}
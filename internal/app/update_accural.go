@@ -1,61 +1,108 @@
 package app
 
 import (
-	"encoding/json"
-	"github.com/go-resty/resty/v2"
+	"context"
+	"errors"
+	"gophermart/internal/accrual"
 	"gophermart/internal/service"
 	"gophermart/internal/storage"
 	"log"
-	"net/http"
 	"time"
 )
 
-func (app *App) UpdateAccrual() error {
-	ordersToUpdate, err := app.userStorage.GetOrdersToUpdate()
+// UpdateAccrual polls the accrual systems about the orders still in progress. Orders of a system
+// that throttles the requests or is paused by its circuit breaker wait for the next run.
+func (app *App) UpdateAccrual(ctx context.Context) error {
+	ordersToUpdate, err := app.userStorage.GetOrdersToUpdate(ctx)
+	if err != nil {
+		return err
+	}
+	accrualAddresses, err := app.accrualAddresses(ctx)
 	if err != nil {
 		return err
 	}
 
-	if len(ordersToUpdate) != 0 {
-		req := resty.New().
-			SetBaseURL(app.config.AccrualAddress).
-			R().
-			SetHeader("Content-Type", "application/json")
-		for _, order := range ordersToUpdate {
+	for _, order := range ordersToUpdate {
+		result, err := app.accrual.Client(accrualAddresses[order.TenantID]).GetOrder(order.Number, ctx)
+		if errors.Is(err, accrual.ErrCircuitOpen) {
+			continue
+		}
+		if err != nil {
+			log.Printf("update accrual: %s for order: %s", err, order.Number)
+			continue
+		}
 
-			orderNum := order.Number
-			resp, err := req.Get("/api/orders/" + orderNum)
+		switch result.Kind {
+		case accrual.Registered, accrual.Processing, accrual.Invalid, accrual.Processed:
+			log.Printf("accrual for order %s updating to %s", order.Number, result.Kind)
+			err = app.userStorage.UpdateOrderStatus(service.Order{
+				TenantID: order.TenantID,
+				Number:   order.Number,
+				Login:    order.Login,
+				Status:   result.Kind.String(),
+				Accrual:  result.Accrual,
+			}, ctx)
 			if err != nil {
-				return err
+				log.Printf("update accrual: save status: %s for order: %s", err, order.Number)
 			}
 
-			status := resp.StatusCode()
-			switch status {
-			case http.StatusTooManyRequests:
-				time.Sleep(storage.UPDATEACCURALTIMER)
-				return nil
-
-			case http.StatusOK:
-				var updatedOrder service.AccrualResponse
-				err = json.Unmarshal(resp.Body(), &updatedOrder)
-				if err != nil {
-					log.Printf("json decode order accrual: %s", err)
-					return err
-				}
-				log.Printf("accrual for order %s updating to %s", updatedOrder.OrderID, updatedOrder.Status)
-
-				orderToUpload := service.Order{
-					Number:  updatedOrder.OrderID,
-					Login:   order.Login,
-					Status:  updatedOrder.Status,
-					Accrual: updatedOrder.Accrual,
-				}
-				err = app.userStorage.UpdateOrderStatus(orderToUpload)
-				if err != nil {
-					return err
-				}
+		case accrual.Unknown:
+			err = app.deferUnknownOrder(order, time.Now(), ctx)
+			if err != nil {
+				log.Printf("update accrual: defer poll: %s for order: %s", err, order.Number)
 			}
 		}
 	}
 	return nil
 }
+
+// deferUnknownOrder backs off the polling of an order the accrual system does not know,
+// and gives up on the order when the accrual system has not learned about it for the max age.
+func (app *App) deferUnknownOrder(order service.Order, now time.Time, ctx context.Context) error {
+	if order.UnknownSince == nil {
+		order.UnknownSince = &now
+	}
+	if now.Sub(*order.UnknownSince) >= app.config.AccrualUnknownMaxAge {
+		log.Printf("order %s is unknown to accrual system since %s, invalidating", order.Number, order.UnknownSince)
+		return app.userStorage.UpdateOrderStatus(service.Order{
+			TenantID:     order.TenantID,
+			Number:       order.Number,
+			Login:        order.Login,
+			Status:       storage.INVALID,
+			StatusReason: service.ReasonUnknownToAccrual,
+		}, ctx)
+	}
+
+	nextPollAt := now.Add(app.unknownOrderBackoff(order.PollAttempts))
+	order.PollAttempts++
+	order.NextPollAt = &nextPollAt
+	return app.userStorage.DeferOrderPoll(order, ctx)
+}
+
+// unknownOrderBackoff doubles the poll interval with every attempt, up to the max backoff.
+func (app *App) unknownOrderBackoff(attempts int) time.Duration {
+	backoff := app.config.AccrualUnknownBackoff
+	for i := 0; i < attempts && backoff < app.config.AccrualUnknownMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > app.config.AccrualUnknownMaxBackoff {
+		return app.config.AccrualUnknownMaxBackoff
+	}
+	return backoff
+}
+
+// accrualAddresses maps every tenant to the accrual system that rates its orders.
+func (app *App) accrualAddresses(ctx context.Context) (map[string]string, error) {
+	tenants, err := app.userStorage.GetTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string, len(tenants))
+	for _, tenant := range tenants {
+		addresses[tenant.ID] = tenant.AccrualAddress
+		if tenant.AccrualAddress == "" {
+			addresses[tenant.ID] = app.config.AccrualAddress
+		}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/accrual"
+	"gophermart/internal/config"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestUnknownOrderBackoff(t *testing.T) {
+	app := &App{config: config.Config{AccrualUnknownBackoff: 30 * time.Second, AccrualUnknownMaxBackoff: 5 * time.Minute}}
+	for attempts, backoff := range []time.Duration{
+		30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute,
+	} {
+		assert.Equal(t, backoff, app.unknownOrderBackoff(attempts), "attempts: %d", attempts)
+	}
+	assert.Equal(t, 5*time.Minute, app.unknownOrderBackoff(1000))
+}
+
+// TestUpdateAccrualUnknownOrder polls an order the fake accrual system does not know, checks that
+// the next poll is deferred by the backoff and that the order is invalidated after the max age.
+func TestUpdateAccrualUnknownOrder(t *testing.T) {
+	app, _ := newAccrualApp(t, config.Config{
+		AccrualUnknownBackoff:    time.Hour,
+		AccrualUnknownMaxBackoff: 4 * time.Hour,
+		AccrualUnknownMaxAge:     72 * time.Hour,
+	})
+	ctx := context.Background()
+	login, _ := uploadOrders(t, app, 1)
+
+	order := func() service.Order {
+		orders, err := app.userStorage.GetOrdersByLogin(login, ctx)
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		return orders[0]
+	}
+
+	start := time.Now()
+	require.NoError(t, app.UpdateAccrual(ctx))
+	deferred := order()
+	assert.Equal(t, storage.NEW, deferred.Status)
+	assert.Equal(t, 1, deferred.PollAttempts)
+	require.NotNil(t, deferred.UnknownSince)
+	require.NotNil(t, deferred.NextPollAt)
+	assert.WithinDuration(t, start.Add(time.Hour), *deferred.NextPollAt, time.Minute)
+
+	require.NoError(t, app.UpdateAccrual(ctx))
+	assert.Equal(t, 1, order().PollAttempts, "the order is not polled before next_poll_at")
+
+	unknownSince := time.Now().Add(-72 * time.Hour)
+	nextPollAt := time.Now().Add(-time.Second)
+	deferred.UnknownSince, deferred.NextPollAt = &unknownSince, &nextPollAt
+	require.NoError(t, app.userStorage.DeferOrderPoll(deferred, ctx))
+
+	require.NoError(t, app.UpdateAccrual(ctx))
+	invalidated := order()
+	assert.Equal(t, storage.INVALID, invalidated.Status)
+	assert.Equal(t, service.ReasonUnknownToAccrual, invalidated.StatusReason)
+}
+
+// TestUpdateAccrualDeletedUser checks that the pending order of a deleted account is still settled
+// and does not hold up the orders of the other users in the batch.
+func TestUpdateAccrualDeletedUser(t *testing.T) {
+	app, fake := newAccrualApp(t, config.Config{})
+	ctx := service.ContextWithTenant(context.Background(), service.Tenant{ID: service.DefaultTenantID})
+
+	deleted, deletedNumbers := uploadOrders(t, app, 1)
+	login, numbers := uploadOrders(t, app, 2)
+	for _, number := range append(deletedNumbers, numbers...) {
+		fake.Set(number, accrual.Result{Kind: accrual.Processed, Accrual: 100})
+	}
+	require.NoError(t, app.userStorage.DeleteUser(deleted, ctx))
+
+	require.NoError(t, app.UpdateAccrual(ctx))
+	orders, err := app.userStorage.GetOrdersByLogin(login, ctx)
+	require.NoError(t, err)
+	for _, order := range orders {
+		assert.Equal(t, storage.PROCESSED, order.Status, "order %s", order.Number)
+	}
+	balance, err := app.userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(200), balance)
+
+	pending, err := app.userStorage.GetOrdersToUpdate(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, pending, "the order of the deleted account is settled too")
+}
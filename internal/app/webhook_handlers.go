@@ -0,0 +1,150 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/gorilla/mux"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var webhookEventTypes = map[string]bool{
+	service.EventUserRegistered:     true,
+	service.EventOrderUploaded:      true,
+	service.EventOrderStatusChanged: true,
+	service.EventPointsCredited:     true,
+	service.EventPointsWithdrawn:    true,
+	service.EventWithdrawalReversed: true,
+	service.EventPointsChargedBack:  true,
+	service.EventPointsExpired:      true,
+}
+
+func (app *App) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var request service.WebhookSubscriptionRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		log.Printf("create webhook: json parse error: %s", err)
+		http.Error(w, fmt.Sprintf("json parse error: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	endpoint, err := url.Parse(request.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		http.Error(w, "webhook url should be an absolute http(s) url", http.StatusBadRequest)
+		return
+	}
+	for _, eventType := range request.EventTypes {
+		if !webhookEventTypes[eventType] {
+			http.Error(w, fmt.Sprintf("unknown event type %q", eventType), http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Secret == "" {
+		request.Secret, err = service.GenerateSecret()
+		if err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	subscription, err := app.userStorage.CreateWebhook(service.WebhookSubscription{
+		URL:        request.URL,
+		Secret:     request.Secret,
+		EventTypes: strings.Join(request.EventTypes, ","),
+	}, r.Context())
+	if err != nil {
+		log.Printf("create webhook: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	// the secret is shown once, at creation
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, subscription)
+}
+
+func (app *App) handleGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := app.userStorage.GetWebhooks(r.Context())
+	if err != nil {
+		log.Printf("get webhooks: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	render.JSON(w, r, subscriptions)
+}
+
+func (app *App) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "webhook id is invalid", http.StatusBadRequest)
+		return
+	}
+
+	err = app.userStorage.DeleteWebhook(uint(id), r.Context())
+	if err != nil {
+		log.Printf("delete webhook: %s for webhook: %d", err, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			http.Error(w, fmt.Sprint(err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (app *App) handleGetWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "webhook id is invalid", http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := app.userStorage.GetWebhookAttempts(uint(id), 100, r.Context())
+	if err != nil {
+		log.Printf("get webhook attempts: %s for webhook: %d", err, id)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, attempts)
+}
+
+func (app *App) handleGetDeadWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := app.userStorage.GetDeadWebhookDeliveries(r.Context())
+	if err != nil {
+		log.Printf("get dead webhook deliveries: %s", err)
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, deliveries)
+}
+
+func (app *App) handleRetryWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "delivery id is invalid", http.StatusBadRequest)
+		return
+	}
+
+	err = app.userStorage.RetryWebhookDelivery(uint(id), r.Context())
+	if err != nil {
+		log.Printf("retry webhook delivery: %s for delivery: %d", err, id)
+		if errors.Is(err, storage.ErrWebhookNotFound) {
+			http.Error(w, fmt.Sprint(err), http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Listener delivers the keys of users that have new events, possibly from other instances.
+type Listener interface {
+	ListenEvents(ctx context.Context, notify func(key string)) error
+}
+
+// Key identifies a user across tenants, logins are unique only within a tenant.
+func Key(tenantID string, login string) string {
+	return tenantID + ":" + login
+}
+
+// Broker fans out "new events" signals to the streams of a user. A signal carries no data,
+// a woken stream reads what it missed from the database itself.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func New() *Broker {
+	return &Broker{subscribers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns the signals for the user of the key made by Key.
+func (broker *Broker) Subscribe(key string) (<-chan struct{}, func()) {
+	signal := make(chan struct{}, 1)
+
+	broker.mu.Lock()
+	if broker.subscribers[key] == nil {
+		broker.subscribers[key] = make(map[chan struct{}]struct{})
+	}
+	broker.subscribers[key][signal] = struct{}{}
+	broker.mu.Unlock()
+
+	return signal, func() {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		delete(broker.subscribers[key], signal)
+		if len(broker.subscribers[key]) == 0 {
+			delete(broker.subscribers, key)
+		}
+	}
+}
+
+func (broker *Broker) Publish(key string) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for signal := range broker.subscribers[key] {
+		select {
+		case signal <- struct{}{}:
+		default:
+			// a signal is already pending, the stream will catch up on everything at once
+		}
+	}
+}
+
+// Listen feeds the broker from the listener until ctx is done, reconnecting after failures.
+func (broker *Broker) Listen(ctx context.Context, listener Listener) {
+	for {
+		err := listener.ListenEvents(ctx, broker.Publish)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("broker: listen events: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
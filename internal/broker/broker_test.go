@@ -0,0 +1,30 @@
+package broker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	broker := New()
+	first, unsubscribeFirst := broker.Subscribe(Key("default", "nevergonna"))
+	second, unsubscribeSecond := broker.Subscribe(Key("default", "nevergonna"))
+	other, unsubscribeOther := broker.Subscribe(Key("default", "letyoudown"))
+	otherTenant, unsubscribeOtherTenant := broker.Subscribe(Key("rickroll", "nevergonna"))
+	defer unsubscribeSecond()
+	defer unsubscribeOther()
+	defer unsubscribeOtherTenant()
+
+	broker.Publish(Key("default", "nevergonna"))
+	broker.Publish(Key("default", "nevergonna"))
+
+	assert.Len(t, first, 1)
+	assert.Len(t, second, 1)
+	assert.Len(t, other, 0)
+	assert.Len(t, otherTenant, 0, "the same login of another tenant is another user")
+
+	<-first
+	unsubscribeFirst()
+	broker.Publish(Key("default", "nevergonna"))
+	assert.Len(t, first, 0)
+}
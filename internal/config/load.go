@@ -0,0 +1,173 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Load builds the config from its layers and validates it. args are the command line arguments
+// without the program name and environ is the environment in the form of os.Environ.
+// The config file is named by the -c flag or the CONFIG_FILE variable.
+func Load(args []string, environ []string) (Config, error) {
+	environment := make(map[string]string, len(environ))
+	for _, variable := range environ {
+		if key, value, ok := strings.Cut(variable, "="); ok {
+			environment[key] = value
+		}
+	}
+
+	// the first pass only finds the config file, the flags are applied once the other layers are in
+	var configFile string
+	var scratch Config
+	err := newFlagSet(&scratch, &configFile, os.Stderr).Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+	if configFile == "" {
+		configFile = environment["CONFIG_FILE"]
+	}
+
+	values := make(map[string]string)
+	if configFile != "" {
+		values, err = readFile(configFile)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	for key, value := range environment {
+		values[key] = value
+	}
+	err = readSecretFiles(values)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	err = env.Parse(&cfg, env.Options{Environment: values})
+	if err != nil {
+		return Config{}, err
+	}
+	err = newFlagSet(&cfg, &configFile, io.Discard).Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func newFlagSet(cfg *Config, configFile *string, output io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("gophermart", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(configFile, "c", *configFile, "Config file, YAML or TOML")
+	flags.StringVar(&cfg.DatabaseDSN, "d", cfg.DatabaseDSN, "Database DSN")
+	flags.StringVar(&cfg.ServerAddress, "a", cfg.ServerAddress, "Server address")
+	flags.StringVar(&cfg.AccrualAddress, "r", cfg.AccrualAddress, "Accrual address")
+	flags.StringVar(&cfg.GRPCAddress, "g", cfg.GRPCAddress, "gRPC server address, empty to disable")
+	flags.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "Log level: debug, info, warn or error")
+	return flags
+}
+
+// readFile reads a YAML or TOML config file into env style values. Unknown keys are
+// reported all at once, they are most likely typos that would silently keep a default.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	document := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		return nil, fmt.Errorf("config file %s should be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	flatten("", document, values)
+
+	known := envNames()
+	var errs Errors
+	for key := range values {
+		if !known[key] {
+			errs = append(errs, fmt.Errorf("unknown key %s in config file %s", strings.ToLower(key), path))
+		}
+	}
+	if len(errs) != 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return nil, errs
+	}
+	return values, nil
+}
+
+func flatten(prefix string, document map[string]interface{}, values map[string]string) {
+	for key, value := range document {
+		key = prefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(key+"_", value, values)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case nil:
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+}
+
+// readSecretFiles reads the secrets not given directly from the files named by <NAME>_FILE,
+// the way container orchestrators mount them.
+func readSecretFiles(values map[string]string) error {
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		name := field.Tag.Get("env")
+		path, ok := values[name+"_FILE"]
+		if field.Tag.Get("secret") == "" || !ok || values[name] != "" {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s_FILE: %w", name, err)
+		}
+		value := strings.TrimSpace(string(data))
+		if field.Type.Kind() == reflect.Slice {
+			value = strings.Join(strings.Fields(value), ",")
+		}
+		values[name] = value
+	}
+	return nil
+}
+
+func envNames() map[string]bool {
+	names := make(map[string]bool)
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if name := field.Tag.Get("env"); name != "" {
+			names[name] = true
+			if field.Tag.Get("secret") != "" {
+				names[name+"_FILE"] = true
+			}
+		}
+	}
+	return names
+}
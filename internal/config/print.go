@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+var dsnPassword = regexp.MustCompile(`(password=)\S+`)
+
+// Print writes the config as a YAML config file, with the secrets redacted.
+func (cfg Config) Print(w io.Writer) error {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	value := reflect.ValueOf(cfg)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := field.Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		document.Content = append(document.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: strings.ToLower(name)},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: redact(format(value.Field(i)), field.Tag.Get("secret"))},
+		)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(document)
+}
+
+// format writes the value the way the env layer reads it.
+func format(value reflect.Value) string {
+	if value.Kind() == reflect.Slice {
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(value.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// redact hides a secret entirely, or only the password in case of a connection string.
+func redact(value string, secret string) string {
+	if value == "" {
+		return value
+	}
+	switch secret {
+	case "true":
+		return redacted
+	case "dsn":
+		connectionURL, err := url.Parse(value)
+		if err == nil && connectionURL.User != nil {
+			if _, ok := connectionURL.User.Password(); ok {
+				connectionURL.User = url.UserPassword(connectionURL.User.Username(), redacted)
+			}
+			return connectionURL.String()
+		}
+		return dsnPassword.ReplaceAllString(value, "${1}"+redacted)
+	}
+	return value
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Errors collects every problem found in the config, so that they are all reported at once.
+type Errors []error
+
+func (errs Errors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// Validate checks the config and returns Errors with every problem found.
+func (cfg Config) Validate() error {
+	var errs Errors
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	positive := func(name string, value time.Duration) {
+		check(value > 0, "%s should be positive, got %s", name, value)
+	}
+	notNegative := func(name string, value time.Duration) {
+		check(value >= 0, "%s should not be negative, got %s", name, value)
+	}
+	atLeast := func(name string, value int, min int) {
+		check(value >= min, "%s should be at least %d, got %d", name, min, value)
+	}
+
+	_, _, err := net.SplitHostPort(cfg.ServerAddress)
+	check(err == nil, "RUN_ADDRESS should be host:port, got %q", cfg.ServerAddress)
+	if cfg.GRPCAddress != "" {
+		_, _, err = net.SplitHostPort(cfg.GRPCAddress)
+		check(err == nil, "GRPC_ADDRESS should be host:port, got %q", cfg.GRPCAddress)
+		check(cfg.GRPCAddress != cfg.ServerAddress, "GRPC_ADDRESS should differ from RUN_ADDRESS")
+	}
+	check(cfg.DatabaseDSN != "", "DATABASE_URI is required")
+	check(cfg.AccrualAddress != "", "ACCRUAL_SYSTEM_ADDRESS is required")
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "LOG_LEVEL should be debug, info, warn or error, got %q", cfg.LogLevel)
+	}
+
+	notNegative("SERVER_READ_TIMEOUT", cfg.ServerReadTimeout)
+	notNegative("SERVER_READ_HEADER_TIMEOUT", cfg.ServerReadHeaderTimeout)
+	notNegative("SERVER_WRITE_TIMEOUT", cfg.ServerWriteTimeout)
+	notNegative("SERVER_IDLE_TIMEOUT", cfg.ServerIdleTimeout)
+	check((cfg.TLSCertFile == "") == (cfg.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE should be set together")
+	for name, path := range map[string]string{"TLS_CERT_FILE": cfg.TLSCertFile, "TLS_KEY_FILE": cfg.TLSKeyFile} {
+		if path != "" {
+			_, err = os.Stat(path)
+			check(err == nil, "%s: %s", name, err)
+		}
+	}
+	notNegative("HSTS_MAX_AGE", cfg.HSTSMaxAge)
+	positive("REQUEST_TIMEOUT", cfg.RequestTimeout)
+	positive("AUTH_REQUEST_TIMEOUT", cfg.AuthRequestTimeout)
+	positive("BATCH_REQUEST_TIMEOUT", cfg.BatchRequestTimeout)
+	bodyLimit := func(name string, value int64) {
+		check(value >= 1, "%s should be at least 1, got %d", name, value)
+	}
+	bodyLimit("MAX_BODY_BYTES", cfg.MaxBodyBytes)
+	bodyLimit("MAX_ORDER_BODY_BYTES", cfg.MaxOrderBodyBytes)
+	bodyLimit("MAX_BATCH_BODY_BYTES", cfg.MaxBatchBodyBytes)
+	check(len(cfg.SessionBlockKeys) == len(cfg.SessionHashKeys),
+		"SESSION_BLOCK_KEYS should have a key for every key of SESSION_HASH_KEYS")
+	for i, key := range cfg.SessionHashKeys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		check(err == nil && len(decoded) >= 32, "SESSION_HASH_KEYS key %d should be base64 of at least 32 bytes", i+1)
+	}
+	for i, key := range cfg.SessionBlockKeys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		check(err == nil && (len(decoded) == 16 || len(decoded) == 24 || len(decoded) == 32),
+			"SESSION_BLOCK_KEYS key %d should be base64 of 16, 24 or 32 bytes", i+1)
+	}
+
+	switch cfg.RateLimitBackend {
+	case "off", "memory", "postgres":
+	default:
+		check(false, "RATE_LIMIT_BACKEND should be off, memory or postgres, got %q", cfg.RateLimitBackend)
+	}
+	positive("RATE_LIMIT_PERIOD", cfg.RateLimitPeriod)
+	atLeast("RATE_LIMIT_IP_REQUESTS", cfg.RateLimitIPRequests, 1)
+	atLeast("RATE_LIMIT_USER_REQUESTS", cfg.RateLimitUserRequests, 1)
+	atLeast("RATE_LIMIT_AUTH_REQUESTS", cfg.RateLimitAuthRequests, 1)
+	atLeast("RATE_LIMIT_ORDER_REQUESTS", cfg.RateLimitOrderRequests, 1)
+	for _, cidr := range cfg.TrustedProxies {
+		_, _, err = net.ParseCIDR(cidr)
+		check(err == nil, "TRUSTED_PROXIES should be a list of CIDR networks, got %q", cidr)
+	}
+
+	atLeast("DB_MAX_OPEN_CONNS", cfg.DBMaxOpenConns, 0)
+	atLeast("DB_MAX_IDLE_CONNS", cfg.DBMaxIdleConns, 0)
+	check(cfg.DBMaxOpenConns == 0 || cfg.DBMaxIdleConns <= cfg.DBMaxOpenConns,
+		"DB_MAX_IDLE_CONNS should not exceed DB_MAX_OPEN_CONNS")
+	notNegative("DB_CONN_MAX_LIFETIME", cfg.DBConnMaxLifetime)
+	notNegative("DB_CONN_MAX_IDLE_TIME", cfg.DBConnMaxIdleTime)
+
+	positive("ACCRUAL_POLL_INTERVAL", cfg.AccrualPollInterval)
+	positive("ACCRUAL_TIMEOUT", cfg.AccrualTimeout)
+	positive("ACCRUAL_RETRY_AFTER", cfg.AccrualRetryAfter)
+	atLeast("ACCRUAL_MAX_RETRIES", cfg.AccrualMaxRetries, 0)
+	positive("ACCRUAL_RETRY_BACKOFF", cfg.AccrualRetryBackoff)
+	atLeast("ACCRUAL_BREAKER_THRESHOLD", cfg.AccrualBreakerThreshold, 1)
+	positive("ACCRUAL_BREAKER_COOLDOWN", cfg.AccrualBreakerCooldown)
+	positive("ACCRUAL_PUSH_TOLERANCE", cfg.AccrualPushTolerance)
+	positive("ACCRUAL_FALLBACK_POLL_INTERVAL", cfg.AccrualFallbackPollInterval)
+	positive("ACCRUAL_UNKNOWN_BACKOFF", cfg.AccrualUnknownBackoff)
+	check(cfg.AccrualUnknownMaxBackoff >= cfg.AccrualUnknownBackoff,
+		"ACCRUAL_UNKNOWN_MAX_BACKOFF should not be less than ACCRUAL_UNKNOWN_BACKOFF")
+	positive("ACCRUAL_UNKNOWN_MAX_AGE", cfg.AccrualUnknownMaxAge)
+
+	atLeast("ORDER_BATCH_LIMIT", cfg.OrderBatchLimit, 1)
+	atLeast("ORDER_NUMBER_MIN_LENGTH", cfg.OrderNumberMinLength, 1)
+	check(cfg.OrderNumberMaxLength >= cfg.OrderNumberMinLength,
+		"ORDER_NUMBER_MAX_LENGTH should not be less than ORDER_NUMBER_MIN_LENGTH")
+
+	positive("RESET_TOKEN_TTL", cfg.ResetTokenTTL)
+	atLeast("RESET_REQUEST_LIMIT", cfg.ResetRequestLimit, 1)
+	positive("RESET_REQUEST_WINDOW", cfg.ResetRequestWindow)
+
+	positive("RECONCILE_INTERVAL", cfg.ReconcileInterval)
+	atLeast("RECONCILE_BATCH_SIZE", cfg.ReconcileBatchSize, 1)
+	for name, value := range map[string]float32{
+		"WITHDRAWAL_MIN_AMOUNT":  cfg.WithdrawalMinAmount,
+		"WITHDRAWAL_MAX_AMOUNT":  cfg.WithdrawalMaxAmount,
+		"WITHDRAWAL_DAILY_CAP":   cfg.WithdrawalDailyCap,
+		"WITHDRAWAL_MONTHLY_CAP": cfg.WithdrawalMonthlyCap,
+	} {
+		check(value >= 0, "%s should not be negative, got %g", name, value)
+	}
+	check(cfg.WithdrawalMaxAmount == 0 || cfg.WithdrawalMinAmount <= cfg.WithdrawalMaxAmount,
+		"WITHDRAWAL_MIN_AMOUNT should not exceed WITHDRAWAL_MAX_AMOUNT")
+	check(cfg.WithdrawalDailyCap == 0 || cfg.WithdrawalMonthlyCap == 0 ||
+		cfg.WithdrawalDailyCap <= cfg.WithdrawalMonthlyCap,
+		"WITHDRAWAL_DAILY_CAP should not exceed WITHDRAWAL_MONTHLY_CAP")
+	check(cfg.WithdrawalMaxOrderShare >= 0 && cfg.WithdrawalMaxOrderShare <= 1,
+		"WITHDRAWAL_MAX_ORDER_SHARE should be from 0 to 1, got %g", cfg.WithdrawalMaxOrderShare)
+	atLeast("POINTS_EXPIRY_MONTHS", cfg.PointsExpiryMonths, 0)
+	positive("EXPIRY_INTERVAL", cfg.ExpiryInterval)
+	notNegative("EXPIRING_SOON_WINDOW", cfg.ExpiringSoonWindow)
+	positive("IDEMPOTENCY_KEY_TTL", cfg.IdempotencyKeyTTL)
+	positive("IDEMPOTENCY_CLEANUP_INTERVAL", cfg.IdempotencyCleanupInterval)
+
+	switch cfg.OutboxSink {
+	case "stdout":
+	case "webhook", "nats":
+		check(cfg.OutboxSinkURL != "", "OUTBOX_SINK_URL is required for the %s sink", cfg.OutboxSink)
+	default:
+		check(false, "OUTBOX_SINK should be stdout, webhook or nats, got %q", cfg.OutboxSink)
+	}
+	positive("OUTBOX_RELAY_INTERVAL", cfg.OutboxRelayInterval)
+	atLeast("OUTBOX_BATCH_SIZE", cfg.OutboxBatchSize, 1)
+
+	positive("WEBHOOK_INTERVAL", cfg.WebhookInterval)
+	positive("WEBHOOK_TIMEOUT", cfg.WebhookTimeout)
+	atLeast("WEBHOOK_MAX_ATTEMPTS", cfg.WebhookMaxAttempts, 1)
+	positive("WEBHOOK_BACKOFF", cfg.WebhookBackoff)
+	check(cfg.WebhookMaxBackoff >= cfg.WebhookBackoff, "WEBHOOK_MAX_BACKOFF should not be less than WEBHOOK_BACKOFF")
+	atLeast("WEBHOOK_BATCH_SIZE", cfg.WebhookBatchSize, 1)
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,49 @@
+package notifier
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users, e.g. password reset links or balance alerts.
+type Notifier interface {
+	Notify(login string, subject string, message string) error
+}
+
+// New returns a FileNotifier appending to path, or a LogNotifier when path is empty.
+// Both are meant for local development, production deployments plug their own Notifier.
+func New(path string) Notifier {
+	if path == "" {
+		return LogNotifier{}
+	}
+	return &FileNotifier{path: path}
+}
+
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(login string, subject string, message string) error {
+	log.Printf("notification for %s: %s: %s", login, subject, message)
+	return nil
+}
+
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (notifier *FileNotifier) Notify(login string, subject string, message string) error {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	file, err := os.OpenFile(notifier.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintf(file, "%s\t%s\t%s\t%s\n", time.Now().Format(time.RFC3339), login, subject, message)
+	return err
+}
@@ -0,0 +1,86 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"gophermart/internal/service"
+	"log"
+	"time"
+)
+
+// EventStorage is the part of storage.UserStorage the relay works with.
+type EventStorage interface {
+	GetUnpublishedEvents(limit int, ctx context.Context) ([]service.OutboxEvent, error)
+	MarkEventPublished(id uint, ctx context.Context) error
+	MarkEventFailed(id uint, reason string, ctx context.Context) error
+	ReleaseEvents(ids []uint, ctx context.Context) error
+}
+
+// Sink is where the relay publishes events to.
+type Sink interface {
+	Publish(ctx context.Context, event service.OutboxEvent) error
+}
+
+// Relay moves events from the outbox table to a sink. An event is marked published only
+// after the sink accepted it, so delivery is at least once and consumers must deduplicate by id.
+// Every instance may run a relay, the storage hands each of them a different batch of events,
+// so the events are in order within a batch but not across the instances.
+type Relay struct {
+	storage   EventStorage
+	sink      Sink
+	batchSize int
+}
+
+func NewRelay(storage EventStorage, sink Sink, batchSize int) *Relay {
+	return &Relay{storage: storage, sink: sink, batchSize: batchSize}
+}
+
+// Relay publishes the pending events in order and stops at the first failure. The failed
+// event and the rest of the batch are released, so that the next run of any instance
+// retries them first instead of publishing newer events ahead of them.
+func (relay *Relay) Relay(ctx context.Context) error {
+	events, err := relay.storage.GetUnpublishedEvents(relay.batchSize, ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, event := range events {
+		err = relay.sink.Publish(ctx, event)
+		if err != nil {
+			log.Printf("outbox: publish event %d: %s", event.ID, err)
+			err = relay.storage.MarkEventFailed(event.ID, err.Error(), ctx)
+			if err != nil {
+				return err
+			}
+			rest := make([]uint, 0, len(events)-i-1)
+			for _, unpublished := range events[i+1:] {
+				rest = append(rest, unpublished.ID)
+			}
+			return relay.storage.ReleaseEvents(rest, ctx)
+		}
+		err = relay.storage.MarkEventPublished(event.ID, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type envelope struct {
+	ID        uint            `json:"id"`
+	TenantID  string          `json:"tenant_id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Marshal encodes the event the way every sink delivers it.
+func Marshal(event service.OutboxEvent) ([]byte, error) {
+	return json.Marshal(envelope{
+		ID:        event.ID,
+		TenantID:  event.TenantID,
+		Type:      event.Type,
+		CreatedAt: event.CreatedAt,
+		Payload:   json.RawMessage(event.Payload),
+	})
+}
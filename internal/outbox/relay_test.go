@@ -0,0 +1,83 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"testing"
+)
+
+type memoryStorage struct {
+	events    []service.OutboxEvent
+	published []uint
+	failed    []uint
+	released  []uint
+}
+
+func (storage *memoryStorage) GetUnpublishedEvents(limit int, _ context.Context) ([]service.OutboxEvent, error) {
+	var events []service.OutboxEvent
+	for _, event := range storage.events {
+		if event.PublishedAt == nil && len(events) < limit {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (storage *memoryStorage) MarkEventPublished(id uint, _ context.Context) error {
+	storage.published = append(storage.published, id)
+	for i := range storage.events {
+		if storage.events[i].ID == id {
+			storage.events[i].PublishedAt = &storage.events[i].CreatedAt
+		}
+	}
+	return nil
+}
+
+func (storage *memoryStorage) MarkEventFailed(id uint, _ string, _ context.Context) error {
+	storage.failed = append(storage.failed, id)
+	return nil
+}
+
+func (storage *memoryStorage) ReleaseEvents(ids []uint, _ context.Context) error {
+	storage.released = append(storage.released, ids...)
+	return nil
+}
+
+type failingSink struct {
+	failOn uint
+	sink   Sink
+}
+
+func (sink failingSink) Publish(ctx context.Context, event service.OutboxEvent) error {
+	if event.ID == sink.failOn {
+		return errors.New("sink is down")
+	}
+	return sink.sink.Publish(ctx, event)
+}
+
+func TestRelay(t *testing.T) {
+	storage := &memoryStorage{events: []service.OutboxEvent{
+		{ID: 1, Type: service.EventUserRegistered, Payload: `{"login":"nevergonna"}`},
+		{ID: 2, Type: service.EventOrderUploaded, Payload: `{"login":"nevergonna","number":"12345678903"}`},
+		{ID: 3, Type: service.EventPointsWithdrawn, Payload: `{"login":"nevergonna","order":"2377225624","sum":5}`},
+	}}
+	var out bytes.Buffer
+	sink := failingSink{failOn: 2, sink: NewWriterSink(&out)}
+	relay := NewRelay(storage, sink, 10)
+
+	err := relay.Relay(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1}, storage.published)
+	assert.Equal(t, []uint{2}, storage.failed)
+	assert.Equal(t, []uint{3}, storage.released, "the rest of the batch is released")
+	assert.Contains(t, out.String(), `"type":"UserRegistered","created_at":"0001-01-01T00:00:00Z","payload":{"login":"nevergonna"}`)
+
+	relay.sink = NewWriterSink(&out)
+	err = relay.Relay(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2, 3}, storage.published)
+}
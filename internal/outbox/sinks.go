@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
+	"gophermart/internal/service"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewSink builds the sink configured by kind: "stdout", "webhook" (url is the endpoint)
+// or "nats" (url is the server url, events go to subject.<event type>).
+func NewSink(kind string, url string, subject string) (Sink, error) {
+	switch kind {
+	case "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case "webhook":
+		return NewWebhookSink(url), nil
+	case "nats":
+		return NewNATSSink(url, subject)
+	}
+	return nil, fmt.Errorf("unknown outbox sink %q", kind)
+}
+
+type WriterSink struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (sink *WriterSink) Publish(_ context.Context, event service.OutboxEvent) error {
+	body, err := Marshal(event)
+	if err != nil {
+		return err
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	_, err = fmt.Fprintf(sink.writer, "%s\n", body)
+	return err
+}
+
+type WebhookSink struct {
+	client *resty.Client
+	url    string
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{client: resty.New().SetTimeout(10 * time.Second), url: url}
+}
+
+func (sink *WebhookSink) Publish(ctx context.Context, event service.OutboxEvent) error {
+	body, err := Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := sink.client.R().SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(sink.url)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("webhook responded with %s", resp.Status())
+	}
+	return nil
+}
+
+// NATSSink publishes to NATS with the official client. The url may carry the credentials
+// and a tls:// scheme, and the connection is re-established in the background when it drops.
+// An event counts as delivered once a flush confirms the server has processed it.
+type NATSSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// natsFlushTimeout bounds the flush of a publish made without a context deadline.
+const natsFlushTimeout = 10 * time.Second
+
+func NewNATSSink(url string, subject string) (*NATSSink, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("gophermart"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Printf("outbox: nats: %s", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &NATSSink{conn: conn, subject: subject}, nil
+}
+
+func (sink *NATSSink) Publish(ctx context.Context, event service.OutboxEvent) error {
+	body, err := Marshal(event)
+	if err != nil {
+		return err
+	}
+	if !sink.conn.IsConnected() {
+		return fmt.Errorf("nats: %s", sink.conn.Status())
+	}
+	err = sink.conn.Publish(sink.subject+"."+event.Type, body)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, natsFlushTimeout)
+		defer cancel()
+	}
+	return sink.conn.FlushWithContext(ctx)
+}
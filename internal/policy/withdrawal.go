@@ -0,0 +1,101 @@
+// Package policy holds the business rules a withdrawal has to satisfy. The rules are plain
+// values taken from the config, zero limits are off, and Check reports the first broken rule.
+package policy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Codes of the broken rules, returned to the clients with the violation message.
+const (
+	AmountNotPositive  = "AMOUNT_NOT_POSITIVE"
+	AmountBelowMin     = "AMOUNT_BELOW_MIN"
+	AmountAboveMax     = "AMOUNT_ABOVE_MAX"
+	DailyCapExceeded   = "DAILY_CAP_EXCEEDED"
+	MonthlyCapExceeded = "MONTHLY_CAP_EXCEEDED"
+	OrderValueRequired = "ORDER_VALUE_REQUIRED"
+	OrderShareExceeded = "ORDER_SHARE_EXCEEDED"
+)
+
+// WithdrawalRules limit a single withdrawal and the points a user withdraws per UTC day and month.
+// MaxOrderShare is the largest part of the order value that can be paid with points, from 0 to 1.
+type WithdrawalRules struct {
+	MinAmount     float32
+	MaxAmount     float32
+	DailyCap      float32
+	MonthlyCap    float32
+	MaxOrderShare float32
+}
+
+// Withdrawal is what the rules are checked against. WithdrawnToday and WithdrawnThisMonth
+// are the sums of the user's withdrawals that were not reversed, without this one.
+type Withdrawal struct {
+	Amount             float32
+	OrderValue         float32
+	WithdrawnToday     float32
+	WithdrawnThisMonth float32
+}
+
+// Violation is the broken rule, its message names the limit.
+type Violation struct {
+	Code    string
+	Message string
+}
+
+func (violation *Violation) Error() string {
+	return violation.Message
+}
+
+func violate(code string, format string, args ...interface{}) *Violation {
+	return &Violation{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// CheckRequest checks the rules that do not depend on the earlier withdrawals, so that
+// a request breaking them is refused before the storage is touched.
+func (rules WithdrawalRules) CheckRequest(amount float32, orderValue float32) error {
+	if amount <= 0 {
+		return violate(AmountNotPositive, "withdrawal amount should be positive, got %.2f", amount)
+	}
+	if rules.MinAmount != 0 && amount < rules.MinAmount {
+		return violate(AmountBelowMin, "withdrawal amount should be at least %.2f, got %.2f", rules.MinAmount, amount)
+	}
+	if rules.MaxAmount != 0 && amount > rules.MaxAmount {
+		return violate(AmountAboveMax, "withdrawal amount should be at most %.2f, got %.2f", rules.MaxAmount, amount)
+	}
+	if rules.MaxOrderShare != 0 {
+		if orderValue <= 0 {
+			return violate(OrderValueRequired, "order value is required to check the share paid with points")
+		}
+		if limit := orderValue * rules.MaxOrderShare; amount > limit {
+			return violate(OrderShareExceeded, "at most %.2f of the order value %.2f can be paid with points, got %.2f",
+				limit, orderValue, amount)
+		}
+	}
+	return nil
+}
+
+// Check checks every rule, the caps with the amounts the user has already withdrawn.
+func (rules WithdrawalRules) Check(withdrawal Withdrawal) error {
+	err := rules.CheckRequest(withdrawal.Amount, withdrawal.OrderValue)
+	if err != nil {
+		return err
+	}
+	if rules.DailyCap != 0 && withdrawal.WithdrawnToday+withdrawal.Amount > rules.DailyCap {
+		return violate(DailyCapExceeded, "daily withdrawal cap is %.2f, %.2f is already withdrawn today",
+			rules.DailyCap, withdrawal.WithdrawnToday)
+	}
+	if rules.MonthlyCap != 0 && withdrawal.WithdrawnThisMonth+withdrawal.Amount > rules.MonthlyCap {
+		return violate(MonthlyCapExceeded, "monthly withdrawal cap is %.2f, %.2f is already withdrawn this month",
+			rules.MonthlyCap, withdrawal.WithdrawnThisMonth)
+	}
+	return nil
+}
+
+// Periods returns the starts of the UTC day and month of now, the caps count the withdrawals since them.
+func Periods(now time.Time) (day time.Time, month time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return day, month
+}
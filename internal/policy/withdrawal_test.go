@@ -0,0 +1,54 @@
+package policy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestWithdrawalRulesCheck(t *testing.T) {
+	rules := WithdrawalRules{MinAmount: 10, MaxAmount: 500, DailyCap: 600, MonthlyCap: 1000, MaxOrderShare: 0.5}
+
+	tests := []struct {
+		name       string
+		withdrawal Withdrawal
+		code       string
+	}{
+		{name: "zero amount", withdrawal: Withdrawal{Amount: 0, OrderValue: 100}, code: AmountNotPositive},
+		{name: "negative amount", withdrawal: Withdrawal{Amount: -5, OrderValue: 100}, code: AmountNotPositive},
+		{name: "below min", withdrawal: Withdrawal{Amount: 5, OrderValue: 100}, code: AmountBelowMin},
+		{name: "above max", withdrawal: Withdrawal{Amount: 501, OrderValue: 2000}, code: AmountAboveMax},
+		{name: "no order value", withdrawal: Withdrawal{Amount: 50}, code: OrderValueRequired},
+		{name: "order share", withdrawal: Withdrawal{Amount: 51, OrderValue: 100}, code: OrderShareExceeded},
+		{name: "daily cap", withdrawal: Withdrawal{Amount: 200, OrderValue: 400, WithdrawnToday: 450,
+			WithdrawnThisMonth: 450}, code: DailyCapExceeded},
+		{name: "monthly cap", withdrawal: Withdrawal{Amount: 200, OrderValue: 400, WithdrawnToday: 100,
+			WithdrawnThisMonth: 900}, code: MonthlyCapExceeded},
+		{name: "within limits", withdrawal: Withdrawal{Amount: 50, OrderValue: 100, WithdrawnToday: 550,
+			WithdrawnThisMonth: 950}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rules.Check(tt.withdrawal)
+			if tt.code == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var violation *Violation
+			require.True(t, errors.As(err, &violation))
+			assert.Equal(t, tt.code, violation.Code)
+		})
+	}
+}
+
+func TestWithdrawalRulesOff(t *testing.T) {
+	assert.NoError(t, WithdrawalRules{}.Check(Withdrawal{Amount: 1e6, WithdrawnToday: 1e6, WithdrawnThisMonth: 1e6}))
+}
+
+func TestPeriods(t *testing.T) {
+	day, month := Periods(time.Date(2024, 3, 15, 1, 30, 0, 0, time.FixedZone("UTC+3", 3*60*60)))
+	assert.Equal(t, time.Date(2024, 3, 14, 0, 0, 0, 0, time.UTC), day)
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), month)
+}
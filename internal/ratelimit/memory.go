@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often Memory drops the buckets that are full again.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	full      time.Time
+}
+
+// Memory keeps the buckets in the process, every instance of the service limits on its own.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+func (memory *Memory) Allow(key string, limit Limit, _ context.Context) (Result, error) {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	now := memory.now()
+	memory.sweep(now)
+
+	current, ok := memory.buckets[key]
+	if !ok {
+		current = &bucket{tokens: float64(limit.Requests), updatedAt: now}
+		memory.buckets[key] = current
+	}
+	var allowed bool
+	current.tokens, allowed = refill(current.tokens, now.Sub(current.updatedAt), limit)
+	current.updatedAt = now
+
+	result := newResult(current.tokens, allowed, limit)
+	current.full = now.Add(result.Reset)
+	return result, nil
+}
+
+func (memory *Memory) Refund(key string, limit Limit, _ context.Context) error {
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	if current, ok := memory.buckets[key]; ok {
+		current.tokens = math.Min(float64(limit.Requests), current.tokens+1)
+	}
+	return nil
+}
+
+// sweep forgets full buckets, a new bucket starts full anyway.
+func (memory *Memory) sweep(now time.Time) {
+	if now.Sub(memory.sweptAt) < sweepInterval {
+		return
+	}
+	memory.sweptAt = now
+	for key, current := range memory.buckets {
+		if !now.Before(current.full) {
+			delete(memory.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	now := time.Now()
+	memory := NewMemory()
+	memory.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Period: 3 * time.Second}
+	ctx := context.Background()
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := memory.Allow("nevergonna", limit, ctx)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+
+	result, err := memory.Allow("nevergonna", limit, ctx)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.Reset)
+
+	result, err = memory.Allow("giveyouup", limit, ctx)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "buckets are per key")
+
+	now = now.Add(time.Second)
+	result, err = memory.Allow("nevergonna", limit, ctx)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "a token is refilled every second")
+	assert.Equal(t, 0, result.Remaining)
+
+	now = now.Add(time.Hour)
+	_, err = memory.Allow("letyoudown", limit, ctx)
+	require.NoError(t, err)
+	assert.Len(t, memory.buckets, 1, "full buckets are swept")
+}
+
+func TestMemoryRefund(t *testing.T) {
+	now := time.Now()
+	memory := NewMemory()
+	memory.now = func() time.Time { return now }
+	limit := Limit{Requests: 2, Period: time.Minute}
+	ctx := context.Background()
+
+	_, err := memory.Allow("nevergonna", limit, ctx)
+	require.NoError(t, err)
+	require.NoError(t, memory.Refund("nevergonna", limit, ctx))
+	require.NoError(t, memory.Refund("nevergonna", limit, ctx))
+	result, err := memory.Allow("nevergonna", limit, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Remaining, "a refund does not overflow the bucket")
+}
+
+func TestSetHeaders(t *testing.T) {
+	header := http.Header{}
+	SetHeaders(header, Result{
+		Limit:      Limit{Requests: 10, Period: time.Minute},
+		Reset:      1500 * time.Millisecond,
+		RetryAfter: 500 * time.Millisecond,
+	})
+	assert.Equal(t, "10", header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "2", header.Get("RateLimit-Reset"))
+	assert.Equal(t, "10;w=60", header.Get("RateLimit-Policy"))
+	assert.Equal(t, "1", header.Get("Retry-After"))
+}
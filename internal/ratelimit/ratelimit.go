@@ -0,0 +1,80 @@
+// Package ratelimit limits requests with token buckets. A bucket holds up to Limit.Requests
+// tokens and refills them evenly over Limit.Period, every request takes a token.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+func (limit Limit) rate() float64 {
+	return float64(limit.Requests) / limit.Period.Seconds()
+}
+
+// Result is the state of a bucket after a request. Reset is the time until the bucket is full again.
+type Result struct {
+	Allowed    bool
+	Limit      Limit
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter takes a token from the bucket of the key. The buckets may live in the process,
+// in Postgres or in any other store that can update a bucket atomically. Refund gives back
+// a token taken for a request that another bucket refused, a bucket never overflows.
+type Limiter interface {
+	Allow(key string, limit Limit, ctx context.Context) (Result, error)
+	Refund(key string, limit Limit, ctx context.Context) error
+}
+
+// refill returns the tokens of a bucket after elapsed time, with a token taken when there is one.
+func refill(tokens float64, elapsed time.Duration, limit Limit) (float64, bool) {
+	tokens = math.Min(float64(limit.Requests), tokens+elapsed.Seconds()*limit.rate())
+	if tokens < 1 {
+		return tokens, false
+	}
+	return tokens - 1, true
+}
+
+func newResult(tokens float64, allowed bool, limit Limit) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(tokens),
+		Reset:     seconds((float64(limit.Requests) - tokens) / limit.rate()),
+	}
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / limit.rate())
+	}
+	return result
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// SetHeaders reports the result in the RateLimit-* headers of the IETF draft, and with
+// Retry-After when the request is refused.
+func SetHeaders(header http.Header, result Result) {
+	header.Set("RateLimit-Limit", strconv.Itoa(result.Limit.Requests))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", result.Limit.Requests, ceilSeconds(result.Limit.Period)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// BucketStorage is the part of storage.UserStorage the shared limiter works with.
+// TakeRateLimitToken refills and takes a token from the bucket of the key in one atomic
+// step and returns the tokens left and whether a token was taken.
+type BucketStorage interface {
+	TakeRateLimitToken(key string, requests int, period time.Duration, now time.Time,
+		ctx context.Context) (float64, bool, error)
+	RefundRateLimitToken(key string, requests int, ctx context.Context) error
+}
+
+// Shared keeps the buckets in the database, so that every instance of the service counts
+// the requests of a client together.
+type Shared struct {
+	storage BucketStorage
+}
+
+func NewShared(storage BucketStorage) *Shared {
+	return &Shared{storage: storage}
+}
+
+func (shared *Shared) Allow(key string, limit Limit, ctx context.Context) (Result, error) {
+	tokens, allowed, err := shared.storage.TakeRateLimitToken(key, limit.Requests, limit.Period, time.Now(), ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	return newResult(tokens, allowed, limit), nil
+}
+
+func (shared *Shared) Refund(key string, limit Limit, ctx context.Context) error {
+	return shared.storage.RefundRateLimitToken(key, limit.Requests, ctx)
+}
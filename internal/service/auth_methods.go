@@ -1,6 +1,9 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"regexp"
@@ -17,20 +20,55 @@ func CheckPasswordHash(password, hash string) bool {
 }
 
 func CheckLoginAndPassword(user User) error {
-	if user.Login == "" {
-		return fmt.Errorf("empty login")
-	}
-	if user.Password == "" {
-		return fmt.Errorf("empty password")
+	err := CheckLogin(user.Login)
+	if err != nil {
+		return err
 	}
+	return CheckPassword(user.Password)
+}
 
+func CheckLogin(login string) error {
+	if login == "" {
+		return fmt.Errorf("empty login")
+	}
 	loginRegex := regexp.MustCompile(`^[\s\S]{6,}$`)
-	if !loginRegex.MatchString(user.Login) {
+	if !loginRegex.MatchString(login) {
 		return fmt.Errorf("login should be at least 6 characters")
 	}
+	return nil
+}
+
+func CheckPassword(password string) error {
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
 	passwordRegex := regexp.MustCompile(`^[\s\S]{8,}$`)
-	if !passwordRegex.MatchString(user.Password) {
+	if !passwordRegex.MatchString(password) {
 		return fmt.Errorf("password should be at least 8 characters")
 	}
 	return nil
 }
+
+// GenerateSecret returns 32 random bytes encoded as hex.
+func GenerateSecret() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// GenerateResetToken returns a random password reset token and the hash to be stored instead of it.
+func GenerateResetToken() (string, string, error) {
+	token, err := GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	return token, HashResetToken(token), nil
+}
+
+func HashResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
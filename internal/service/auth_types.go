@@ -2,14 +2,33 @@ package service
 
 import (
 	"gorm.io/gorm"
+	"time"
 )
 
 type User struct {
 	gorm.Model
-	Name     string  `json:"name"`
-	Login    string  `json:"login" gorm:"unique"`
-	Password string  `json:"password"`
-	Balance  float32 `json:"accrual,omitempty"`
+	TenantID       string  `json:"-" gorm:"not null;default:'default';uniqueIndex:idx_users_tenant_login"`
+	Name           string  `json:"name"`
+	Login          string  `json:"login" gorm:"uniqueIndex:idx_users_tenant_login"`
+	Password       string  `json:"password"`
+	Balance        float32 `json:"accrual,omitempty"`
+	SessionVersion int     `json:"-" gorm:"not null;default:0"`
+}
+
+type Profile struct {
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+// ProfileUpdate holds the profile fields a user wants to change, nil fields are left untouched.
+type ProfileUpdate struct {
+	Login *string `json:"login"`
+	Name  *string `json:"name"`
+}
+
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
 type Authentication struct {
@@ -17,4 +36,20 @@ type Authentication struct {
 	Password string `json:"password"`
 }
 
-var SecretKey = "watch?v=Qw4w9WgXcQ"
+// PasswordResetToken stores only the hash of a reset token, the token itself is sent to the user.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint   `gorm:"index"`
+	TokenHash string `gorm:"uniqueIndex"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type PasswordReset struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
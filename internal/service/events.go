@@ -0,0 +1,84 @@
+package service
+
+import (
+	"time"
+)
+
+const (
+	EventUserRegistered     = "UserRegistered"
+	EventOrderUploaded      = "OrderUploaded"
+	EventOrderStatusChanged = "OrderStatusChanged"
+	EventPointsCredited     = "PointsCredited"
+	EventPointsWithdrawn    = "PointsWithdrawn"
+	EventWithdrawalReversed = "WithdrawalReversed"
+	EventPointsChargedBack  = "PointsChargedBack"
+	EventPointsExpired      = "PointsExpired"
+)
+
+// OutboxEvent is a domain event written in the same transaction as the change it describes
+// and published later by the outbox relay.
+type OutboxEvent struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Type        string     `json:"type"`
+	TenantID    string     `json:"tenant_id" gorm:"not null;default:'default';index"`
+	Login       string     `json:"-" gorm:"index"`
+	Payload     string     `json:"-" gorm:"type:jsonb"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"-" gorm:"index"`
+	LockedUntil *time.Time `json:"-"`
+	Attempts    int        `json:"-"`
+	LastError   string     `json:"-"`
+}
+
+type UserRegistered struct {
+	Login string `json:"login"`
+}
+
+type OrderUploaded struct {
+	Login  string      `json:"login"`
+	Number OrderNumber `json:"number"`
+}
+
+type OrderStatusChanged struct {
+	Login   string      `json:"login"`
+	Number  OrderNumber `json:"number"`
+	Status  string      `json:"status"`
+	Accrual float32     `json:"accrual,omitempty"`
+}
+
+type PointsCredited struct {
+	Login   string      `json:"login"`
+	Number  OrderNumber `json:"order"`
+	Amount  float32     `json:"sum"`
+	Balance float32     `json:"balance"`
+}
+
+type PointsWithdrawn struct {
+	Login   string      `json:"login"`
+	Number  OrderNumber `json:"order"`
+	Amount  float32     `json:"sum"`
+	Balance float32     `json:"balance"`
+}
+
+type WithdrawalReversed struct {
+	Login   string      `json:"login"`
+	Number  OrderNumber `json:"order"`
+	Amount  float32     `json:"sum"`
+	Reason  string      `json:"reason"`
+	Balance float32     `json:"balance"`
+}
+
+type PointsChargedBack struct {
+	Login       string      `json:"login"`
+	Number      OrderNumber `json:"order"`
+	Amount      float32     `json:"sum"`
+	Unrecovered float32     `json:"unrecovered,omitempty"`
+	Balance     float32     `json:"balance"`
+}
+
+type PointsExpired struct {
+	Login   string      `json:"login"`
+	Number  OrderNumber `json:"order"`
+	Amount  float32     `json:"sum"`
+	Balance float32     `json:"balance"`
+}
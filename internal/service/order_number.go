@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OrderNumber is a digit-only order number of arbitrary length. It is kept as a string
+// so that long numbers don't overflow and leading zeros survive.
+type OrderNumber string
+
+type OrderNumberLimits struct {
+	MinLength int
+	MaxLength int
+}
+
+var (
+	ErrOrderNumberNotDigits = errors.New("order number should contain only digits")
+	ErrOrderNumberLength    = errors.New("order number has invalid length")
+	ErrOrderNumberChecksum  = errors.New("order number fails luhn check")
+	ErrOrderNumberZero      = errors.New("order number should not be all zeros")
+)
+
+// ParseOrderNumber trims surrounding whitespace and validates the number against the limits and the Luhn checksum.
+func ParseOrderNumber(raw string, limits OrderNumberLimits) (OrderNumber, error) {
+	number := strings.TrimSpace(raw)
+	if number == "" {
+		return "", ErrOrderNumberNotDigits
+	}
+	for _, digit := range number {
+		if digit < '0' || digit > '9' {
+			return "", ErrOrderNumberNotDigits
+		}
+	}
+
+	if len(number) < limits.MinLength || (limits.MaxLength > 0 && len(number) > limits.MaxLength) {
+		return "", fmt.Errorf("%w: should be from %d to %d digits", ErrOrderNumberLength, limits.MinLength, limits.MaxLength)
+	}
+	// any run of zeros passes the Luhn check
+	if strings.Trim(number, "0") == "" {
+		return "", ErrOrderNumberZero
+	}
+	if !ValidLuhn(number) {
+		return "", ErrOrderNumberChecksum
+	}
+	return OrderNumber(number), nil
+}
+
+// ValidLuhn checks the Luhn checksum of a string of digits.
+func ValidLuhn(digits string) bool {
+	var sum int
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		digit := int(digits[i] - '0')
+		if digit < 0 || digit > 9 {
+			return false
+		}
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func (number OrderNumber) String() string {
+	return string(number)
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseOrderNumber(t *testing.T) {
+	limits := OrderNumberLimits{MinLength: 2, MaxLength: 32}
+	tests := []struct {
+		name   string
+		raw    string
+		number OrderNumber
+		err    error
+	}{
+		{
+			name:   "valid",
+			raw:    "12345678903",
+			number: "12345678903",
+		},
+		{
+			name:   "surrounding whitespace",
+			raw:    " 12345678903\n",
+			number: "12345678903",
+		},
+		{
+			name:   "leading zeros are kept",
+			raw:    "0012345678903",
+			number: "0012345678903",
+		},
+		{
+			name:   "longer than int64",
+			raw:    "123456789012345678901234567891",
+			number: "123456789012345678901234567891",
+		},
+		{
+			name: "checksum failure",
+			raw:  "12345678902",
+			err:  ErrOrderNumberChecksum,
+		},
+		{
+			name: "not digits",
+			raw:  "12345abc",
+			err:  ErrOrderNumberNotDigits,
+		},
+		{
+			name: "negative",
+			raw:  "-0",
+			err:  ErrOrderNumberNotDigits,
+		},
+		{
+			name: "empty",
+			raw:  "",
+			err:  ErrOrderNumberNotDigits,
+		},
+		{
+			name: "too short",
+			raw:  "0",
+			err:  ErrOrderNumberLength,
+		},
+		{
+			name: "all zeros",
+			raw:  "000",
+			err:  ErrOrderNumberZero,
+		},
+		{
+			name: "too long",
+			raw:  "1234567890123456789012345678901234567898",
+			err:  ErrOrderNumberLength,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			number, err := ParseOrderNumber(tt.raw, limits)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.number, number)
+		})
+	}
+}
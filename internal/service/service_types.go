@@ -4,29 +4,137 @@ import (
 	"time"
 )
 
+// Order is a purchase uploaded for rating by the accrual system. StatusReason explains a status
+// the gophermart set itself. The poll fields track the orders the accrual system does not know:
+// UnknownSince is when it first answered so, and NextPollAt backs off with every PollAttempts.
 type Order struct {
-	Number     string    `json:"number,omitempty" gorm:"unique"`
-	Login      string    `json:"-"`
-	Status     string    `json:"status,omitempty"`
-	Accrual    float32   `json:"accrual,omitempty"`
-	UploadedAt time.Time `json:"uploaded_at,omitempty"`
+	TenantID     string      `json:"-" gorm:"not null;default:'default';uniqueIndex:idx_orders_tenant_number"`
+	Number       OrderNumber `json:"number,omitempty" gorm:"uniqueIndex:idx_orders_tenant_number"`
+	Login        string      `json:"-"`
+	Status       string      `json:"status,omitempty"`
+	StatusReason string      `json:"reason,omitempty"`
+	Accrual      float32     `json:"accrual,omitempty"`
+	UploadedAt   time.Time   `json:"uploaded_at,omitempty"`
+	PollAttempts int         `json:"-"`
+	UnknownSince *time.Time  `json:"-"`
+	NextPollAt   *time.Time  `json:"-" gorm:"index"`
+	ReconciledAt *time.Time  `json:"-" gorm:"index"`
+}
+
+// ReasonUnknownToAccrual is the reason of the orders invalidated after the accrual system
+// did not learn about them for too long.
+const ReasonUnknownToAccrual = "unknown to accrual"
+
+type OrderUploadResult struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
 }
 
 type AccrualResponse struct {
-	OrderID string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float32 `json:"accrual"`
+	OrderID OrderNumber `json:"order"`
+	Status  string      `json:"status"`
+	Accrual float32     `json:"accrual"`
 }
 
+// Balance is the account summary of a user. Pending is the number of orders still waiting
+// for the accrual system and Available is the part of Current that can be withdrawn, it is
+// zero while a chargeback keeps Current below zero.
 type Balance struct {
-	Login     string  `json:"-"`
-	Current   float32 `json:"current"`
-	Withdrawn float32 `json:"withdrawn"`
+	Login          string  `json:"-"`
+	Current        float32 `json:"current"`
+	Withdrawn      float32 `json:"withdrawn"`
+	ExpiringSoon   float32 `json:"expiring_soon"`
+	Pending        int64   `json:"pending"`
+	Available      float32 `json:"available"`
+	LifetimeEarned float32 `json:"lifetime_earned"`
+}
+
+// PointLot is a portion of credited points that expires as a whole. Withdrawals and
+// chargebacks consume lots first in first out, expiry writes off what is left of a lot.
+type PointLot struct {
+	ID          uint   `gorm:"primaryKey"`
+	TenantID    string `gorm:"not null;default:'default';index"`
+	Login       string `gorm:"index"`
+	OrderNumber OrderNumber
+	Source      string
+	Amount      float32
+	Remaining   float32
+	CreditedAt  time.Time
+	ExpiresAt   *time.Time `gorm:"index"`
+}
+
+type PointExpiry struct {
+	ID          uint        `json:"-" gorm:"primaryKey"`
+	TenantID    string      `json:"-" gorm:"not null;default:'default';index"`
+	Login       string      `json:"-" gorm:"index"`
+	LotID       uint        `json:"-"`
+	OrderNumber OrderNumber `json:"order"`
+	Amount      float32     `json:"sum"`
+	Unrecovered float32     `json:"unrecovered,omitempty"`
+	ExpiredAt   time.Time   `json:"expired_at"`
+}
+
+type HistoryEntry struct {
+	Type   string      `json:"type"`
+	Order  OrderNumber `json:"order"`
+	Amount float32     `json:"sum"`
+	At     time.Time   `json:"at"`
 }
 
 type Withdrawal struct {
-	Login       string    `json:"-"`
-	OrderID     string    `json:"order" gorm:"primaryKey"`
-	Amount      float32   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at,omitempty"`
+	TenantID       string      `json:"-" gorm:"primaryKey;default:'default'"`
+	Login          string      `json:"-"`
+	OrderID        OrderNumber `json:"order" gorm:"primaryKey"`
+	Amount         float32     `json:"sum"`
+	OrderValue     float32     `json:"order_value,omitempty"`
+	ProcessedAt    time.Time   `json:"processed_at,omitempty"`
+	Status         string      `json:"status,omitempty" gorm:"not null;default:COMPLETED"`
+	ReversedAt     *time.Time  `json:"reversed_at,omitempty"`
+	ReversalReason string      `json:"reversal_reason,omitempty"`
+}
+
+// OrderClaim reserves an order number of a tenant for either an accrual order or a withdrawal.
+// Its primary key keeps a number from being used twice, across the orders and withdrawals tables.
+type OrderClaim struct {
+	TenantID  string      `gorm:"primaryKey;default:'default'"`
+	Number    OrderNumber `gorm:"primaryKey"`
+	Kind      string      `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// Chargeback records points taken back after the accrual system lowered or revoked an accrual.
+// Unrecovered is the part that could not be debited without driving the balance negative.
+type Chargeback struct {
+	ID          uint        `json:"-" gorm:"primaryKey"`
+	TenantID    string      `json:"-" gorm:"not null;default:'default';index"`
+	Login       string      `json:"-" gorm:"index"`
+	OrderNumber OrderNumber `json:"order"`
+	Amount      float32     `json:"sum"`
+	Unrecovered float32     `json:"unrecovered,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+type WithdrawalReversal struct {
+	Reason string `json:"reason"`
+}
+
+// IdempotencyKey remembers the outcome of a mutating request so that a retry with the same key
+// gets the original response. StatusCode stays zero while the first request is in flight.
+type IdempotencyKey struct {
+	TenantID    string `gorm:"primaryKey;default:'default'"`
+	Login       string `gorm:"primaryKey"`
+	Key         string `gorm:"primaryKey"`
+	Fingerprint string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+// RateLimitBucket is a token bucket of the shared rate limiter, the key names the client and the limit.
+type RateLimitBucket struct {
+	Key       string `gorm:"primaryKey"`
+	Tokens    float64
+	Allowed   bool
+	UpdatedAt time.Time `gorm:"index"`
 }
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTenantID is the tenant of requests that name no tenant and of the data
+// created before tenants were introduced.
+const DefaultTenantID = "default"
+
+// Tenant is a storefront served by the deployment. Zero rule fields fall back to the config.
+// AccrualPushSecret signs the pushes of the tenant's accrual system, it is only shown on creation.
+type Tenant struct {
+	ID                   string    `json:"id" gorm:"primaryKey"`
+	Name                 string    `json:"name"`
+	Host                 string    `json:"host,omitempty" gorm:"index"`
+	AccrualAddress       string    `json:"accrual_address,omitempty"`
+	AccrualPushSecret    string    `json:"accrual_push_secret,omitempty"`
+	OrderBatchLimit      int       `json:"order_batch_limit,omitempty"`
+	OrderNumberMinLength int       `json:"order_number_min_length,omitempty"`
+	OrderNumberMaxLength int       `json:"order_number_max_length,omitempty"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+type tenantContextKey struct{}
+
+// ContextWithTenant binds the context to the tenant. Storage scopes every query
+// of a tenant owned model made with such a context to the tenant.
+func ContextWithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant bound to the context. Contexts of background jobs
+// are not bound to a tenant and see the data of every tenant.
+func TenantFromContext(ctx context.Context) (Tenant, bool) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(Tenant)
+	return tenant, ok
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"strings"
+	"time"
+)
+
+// WebhookSubscription is an endpoint that receives signed deliveries of domain events.
+// EventTypes is a comma separated list, an empty one subscribes to every event.
+type WebhookSubscription struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	TenantID   string    `json:"tenant_id" gorm:"not null;default:'default';index"`
+	URL        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes string    `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (subscription WebhookSubscription) Wants(eventType string) bool {
+	if subscription.EventTypes == "" {
+		return true
+	}
+	for _, wanted := range strings.Split(subscription.EventTypes, ",") {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"event_types"`
+}
+
+type WebhookDelivery struct {
+	ID             uint                `json:"id" gorm:"primaryKey"`
+	SubscriptionID uint                `json:"subscription_id" gorm:"index"`
+	Subscription   WebhookSubscription `json:"-"`
+	EventID        uint                `json:"event_id"`
+	EventType      string              `json:"event_type"`
+	Payload        string              `json:"-" gorm:"type:jsonb"`
+	EventCreatedAt time.Time           `json:"event_created_at"`
+	Status         string              `json:"status" gorm:"index"`
+	Attempts       int                 `json:"attempts"`
+	NextAttemptAt  time.Time           `json:"next_attempt_at" gorm:"index"`
+	LastError      string              `json:"last_error,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+	DeliveredAt    *time.Time          `json:"delivered_at,omitempty"`
+}
+
+// WebhookAttempt is an entry of the delivery log.
+type WebhookAttempt struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	DeliveryID     uint      `json:"delivery_id" gorm:"index"`
+	SubscriptionID uint      `json:"subscription_id" gorm:"index"`
+	EventType      string    `json:"event_type"`
+	ResponseCode   int       `json:"response_code,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Duration       int64     `json:"duration_ms"`
+	AttemptedAt    time.Time `json:"attempted_at"`
+}
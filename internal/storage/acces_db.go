@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"gophermart/internal/policy"
 	"gophermart/internal/service"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"time"
 )
 
@@ -20,11 +22,13 @@ func (dbStorage DBStorage) RegisterUser(user service.User, ctx context.Context)
 			}
 			user.Password = hashedPassword
 			user.Balance = 0
-			err = dbStorage.db.WithContext(ctx).Create(&user).Error
-			if err != nil {
-				return err
-			}
-			return nil
+			return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				err := tx.Create(&user).Error
+				if err != nil {
+					return err
+				}
+				return addEvent(tx, service.EventUserRegistered, user.Login, service.UserRegistered{Login: user.Login})
+			})
 		}
 		return err
 	}
@@ -49,9 +53,12 @@ func (dbStorage DBStorage) CheckUserAuth(authDetails service.Authentication, ctx
 }
 
 func (dbStorage DBStorage) PutOrder(order service.Order, ctx context.Context) error {
+	if err := requireTenant(ctx); err != nil {
+		return err
+	}
 	var checkingOrder service.Order
 
-	err := dbStorage.db.WithContext(ctx).Where("login  = 	?  AND nuumber = ?", order.Login, order.Number).First(&checkingOrder).Error
+	err := dbStorage.db.WithContext(ctx).Where("login  = 	?  AND number = ?", order.Login, order.Number).First(&checkingOrder).Error
 	if checkingOrder.Login != "" {
 		return ErrAlreadyExists
 	}
@@ -73,43 +80,204 @@ func (dbStorage DBStorage) PutOrder(order service.Order, ctx context.Context) er
 
 	order.Status = NEW
 	order.UploadedAt = time.Now()
-	err = dbStorage.db.WithContext(ctx).Create(&order).Error
-	if err != nil {
-		return err
+	return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := claimOrderNumber(tx, order.Number, ClaimOrder, order.Login)
+		if err != nil {
+			return err
+		}
+		err = tx.Create(&order).Error
+		if err != nil {
+			return err
+		}
+		return addEvent(tx, service.EventOrderUploaded, order.Login,
+			service.OrderUploaded{Login: order.Login, Number: order.Number})
+	})
+}
+
+// PutOrders uploads a batch of order numbers in a single transaction and reports
+// the outcome for each of them in the order they were given.
+func (dbStorage DBStorage) PutOrders(login string, numbers []service.OrderNumber, ctx context.Context) ([]service.OrderUploadResult, error) {
+	if err := requireTenant(ctx); err != nil {
+		return nil, err
 	}
+	results := make([]service.OrderUploadResult, len(numbers))
+	err := dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existingOrders []service.Order
+		err := tx.Where("number IN ?", numbers).Find(&existingOrders).Error
+		if err != nil {
+			return err
+		}
+		owners := make(map[service.OrderNumber]string, len(existingOrders))
+		for _, order := range existingOrders {
+			owners[order.Number] = order.Login
+		}
+		var withdrawalClaims []service.OrderClaim
+		err = tx.Where("number IN ? AND kind = ?", numbers, ClaimWithdrawal).Find(&withdrawalClaims).Error
+		if err != nil {
+			return err
+		}
+		withdrawn := make(map[service.OrderNumber]bool, len(withdrawalClaims))
+		for _, claim := range withdrawalClaims {
+			withdrawn[claim.Number] = true
+		}
 
-	return nil
+		var newOrders []service.Order
+		accepted := make(map[service.OrderNumber]int)
+		for i, number := range numbers {
+			results[i].Number = number.String()
+			owner, exists := owners[number]
+			switch {
+			case withdrawn[number]:
+				results[i].Result = UploadUsedForWithdraw
+			case !exists:
+				results[i].Result = UploadAccepted
+				owners[number] = login
+				accepted[number] = i
+				newOrders = append(newOrders, service.Order{
+					Number:     number,
+					Login:      login,
+					Status:     NEW,
+					UploadedAt: time.Now(),
+				})
+			case owner == login:
+				results[i].Result = UploadAlreadyUploaded
+			default:
+				results[i].Result = UploadedByAnotherUser
+			}
+		}
+
+		if len(newOrders) == 0 {
+			return nil
+		}
+		newOrders, err = claimNewOrders(tx, login, newOrders, func(number service.OrderNumber, result string) {
+			results[accepted[number]].Result = result
+		})
+		if err != nil {
+			return err
+		}
+		if len(newOrders) == 0 {
+			return nil
+		}
+		err = tx.Create(&newOrders).Error
+		if err != nil {
+			return err
+		}
+		for _, order := range newOrders {
+			err = addEvent(tx, service.EventOrderUploaded, login, service.OrderUploaded{Login: login, Number: order.Number})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
 }
 
-func (dbStorage DBStorage) GetOrdersToUpdate() ([]service.Order, error) {
+// GetOrdersToUpdate returns the orders in progress that are due to be polled.
+func (dbStorage DBStorage) GetOrdersToUpdate(ctx context.Context) ([]service.Order, error) {
 	var ordersToUpdate []service.Order
-	err := dbStorage.db.Where("status = ?", NEW).Or("status = ?", REGISTERED).
-		Or("status = ?", PROCESSING).Find(&ordersToUpdate).Error
+	err := dbStorage.db.WithContext(ctx).Where("status IN ?", []string{NEW, REGISTERED, PROCESSING}).
+		Where("next_poll_at IS NULL OR next_poll_at <= ?", time.Now()).Find(&ordersToUpdate).Error
 	if err != nil {
 		return nil, err
 	}
 	return ordersToUpdate, nil
 }
 
-func (dbStorage DBStorage) UpdateOrderStatus(order service.Order) error {
-	err := dbStorage.db.Model(&service.Order{}).Where("number = ?", order.Number).
-		Updates(service.Order{Status: order.Status, Accrual: order.Accrual}).Error
-	if err != nil {
-		return err
-	}
+// orderStatusRank orders the statuses an order goes through, the final ones share the last rank.
+var orderStatusRank = map[string]int{NEW: 0, REGISTERED: 1, PROCESSING: 2, PROCESSED: 3, INVALID: 3}
 
-	var user service.User
-	err = dbStorage.db.Where("login  = 	?", order.Login).First(&user).Error
-	if err != nil {
-		return err
+// StatusRegresses reports whether the next status would move an order back, or from a final
+// status to another one. The accrual system may answer a poll and a push out of order.
+func StatusRegresses(current string, next string) bool {
+	if current == PROCESSED || current == INVALID {
+		return current != next
 	}
+	return orderStatusRank[next] < orderStatusRank[current]
+}
 
-	user.Balance = user.Balance + order.Accrual
-	err = dbStorage.db.Save(&user).Error
-	if err != nil {
-		return err
+// UpdateOrderStatus saves the accrual system verdict for an order and credits the accrual
+// once, when the order becomes PROCESSED. Orders already in a final status are left untouched,
+// and so are the orders the verdict would move back to an earlier status.
+// A known order is polled on every run again, so its unknown order tracking is reset.
+func (dbStorage DBStorage) UpdateOrderStatus(order service.Order, ctx context.Context) error {
+	return dbStorage.inTx(tenantContext(ctx, order.TenantID), func(tx *gorm.DB) error {
+		user, err := lockUser(tx, order.Login)
+		if err != nil {
+			return err
+		}
+
+		var current service.Order
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", order.Number).First(&current).Error
+		if err != nil {
+			return err
+		}
+		if current.Status == PROCESSED || current.Status == INVALID || StatusRegresses(current.Status, order.Status) {
+			return nil
+		}
+
+		err = tx.Model(&service.Order{}).Where("number = ?", order.Number).Updates(map[string]interface{}{
+			"status":        order.Status,
+			"status_reason": order.StatusReason,
+			"accrual":       order.Accrual,
+			"poll_attempts": 0,
+			"unknown_since": nil,
+			"next_poll_at":  nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != order.Status {
+			err = addEvent(tx, service.EventOrderStatusChanged, order.Login, service.OrderStatusChanged{
+				Login: order.Login, Number: order.Number, Status: order.Status, Accrual: order.Accrual,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if order.Status != PROCESSED || order.Accrual <= 0 {
+			return nil
+		}
+
+		err = tx.Unscoped().Model(&service.User{}).Where("login = ?", order.Login).
+			Update("balance", gorm.Expr("balance + ?", order.Accrual)).Error
+		if err != nil {
+			return err
+		}
+		err = dbStorage.creditLot(tx, order.Login, order.Number, order.Accrual, HistoryAccrual)
+		if err != nil {
+			return err
+		}
+		return addEvent(tx, service.EventPointsCredited, order.Login, service.PointsCredited{
+			Login: order.Login, Number: order.Number, Amount: order.Accrual, Balance: user.Balance + order.Accrual,
+		})
+	})
+}
+
+// DeferOrderPoll saves the unknown order tracking of an order still in progress.
+func (dbStorage DBStorage) DeferOrderPoll(order service.Order, ctx context.Context) error {
+	return dbStorage.db.WithContext(tenantContext(ctx, order.TenantID)).Model(&service.Order{}).
+		Where("number = ? AND status IN ?", order.Number, []string{NEW, REGISTERED, PROCESSING}).
+		Updates(map[string]interface{}{
+			"poll_attempts": order.PollAttempts,
+			"unknown_since": order.UnknownSince,
+			"next_poll_at":  order.NextPollAt,
+		}).Error
+}
+
+func (dbStorage DBStorage) GetOrder(number service.OrderNumber, ctx context.Context) (service.Order, error) {
+	if err := requireTenant(ctx); err != nil {
+		return service.Order{}, err
 	}
-	return nil
+	var order service.Order
+	err := dbStorage.db.WithContext(ctx).Where("number = ?", number).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return service.Order{}, ErrOrderNotFound
+	}
+	return order, err
 }
 
 func (dbStorage DBStorage) GetOrdersByLogin(login string, ctx context.Context) ([]service.Order, error) {
@@ -135,60 +303,120 @@ func (dbStorage DBStorage) GetBalanceByLogin(login string, ctx context.Context)
 	return user.Balance, nil
 }
 
+// Withdraw debits the user for a new order. The order number must not have been used for
+// a withdrawal or an accrual order before, of this user or any other.
 func (dbStorage DBStorage) Withdraw(withdrawal service.Withdrawal, ctx context.Context) error {
-	var user service.User
-
-	tx := dbStorage.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	err := tx.WithContext(ctx).Where("login  = 	?", withdrawal.Login).First(&user).Error
-	if err != nil {
-		tx.Rollback()
+	if err := requireTenant(ctx); err != nil {
 		return err
 	}
+	return dbStorage.inTx(ctx, func(tx *gorm.DB) error {
+		user, err := lockUser(tx, withdrawal.Login)
+		if err != nil {
+			return err
+		}
+		err = checkWithdrawalRules(tx, withdrawal, dbStorage.settings.WithdrawalRules)
+		if err != nil {
+			return err
+		}
+		err = claimOrderNumber(tx, withdrawal.OrderID, ClaimWithdrawal, withdrawal.Login)
+		if err != nil {
+			return err
+		}
+
+		newBalance := user.Balance - withdrawal.Amount
+		if newBalance < 0 {
+			return ErrNotEnoughPoints
+		}
 
-	newBalance := user.Balance - withdrawal.Amount
-	if newBalance >= 0 {
 		withdrawal.ProcessedAt = time.Now()
-		err = tx.WithContext(ctx).Save(&withdrawal).Where("order = ?", withdrawal.OrderID).Error
+		withdrawal.Status = WithdrawalCompleted
+		err = tx.Create(&withdrawal).Error
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		err = tx.WithContext(ctx).Model(&service.User{}).
-			Where("login = ?", withdrawal.Login).Update("balance", newBalance).Error
+		err = tx.Model(&service.User{}).Where("login = ?", withdrawal.Login).Update("balance", newBalance).Error
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		err = tx.Commit().Error
+		err = consumeLots(tx, withdrawal.Login, withdrawal.Amount, "")
 		if err != nil {
-			tx.Rollback()
 			return err
 		}
-		return nil
+		return addEvent(tx, service.EventPointsWithdrawn, withdrawal.Login, service.PointsWithdrawn{
+			Login: withdrawal.Login, Number: withdrawal.OrderID, Amount: withdrawal.Amount, Balance: newBalance,
+		})
+	})
+}
+
+// checkWithdrawalRules checks the withdrawal against the rules, the caps with the withdrawals of the
+// current UTC day and month. It runs with the user locked, so concurrent withdrawals can not pass a cap together.
+func checkWithdrawalRules(tx *gorm.DB, withdrawal service.Withdrawal, rules policy.WithdrawalRules) error {
+	check := policy.Withdrawal{Amount: withdrawal.Amount, OrderValue: withdrawal.OrderValue}
+	if rules.DailyCap != 0 || rules.MonthlyCap != 0 {
+		day, month := policy.Periods(time.Now())
+		var withdrawn struct {
+			Today     float32
+			ThisMonth float32
+		}
+		err := tx.Model(&service.Withdrawal{}).
+			Select("coalesce(sum(amount) filter (where processed_at >= ?), 0) as today, "+
+				"coalesce(sum(amount), 0) as this_month", day).
+			Where("login = ? AND status <> ? AND processed_at >= ?", withdrawal.Login, WithdrawalReversed, month).
+			Scan(&withdrawn).Error
+		if err != nil {
+			return err
+		}
+		check.WithdrawnToday = withdrawn.Today
+		check.WithdrawnThisMonth = withdrawn.ThisMonth
 	}
-	tx.Rollback()
-	return ErrNotEnoughPoints
+	return rules.Check(check)
 }
 
 func (dbStorage DBStorage) GetWithdrawnAmount(login string, ctx context.Context) (float32, error) {
-	var withdrawals []service.Withdrawal
-	err := dbStorage.db.WithContext(ctx).Where("login  = 	?", login).Find(&withdrawals).Error
+	var withdrawn float32
+	err := dbStorage.db.WithContext(ctx).Model(&service.Withdrawal{}).Select("coalesce(sum(amount), 0)").
+		Where("login  = 	? AND status <> ?", login, WithdrawalReversed).Scan(&withdrawn).Error
 	if err != nil {
 		return 0, err
 	}
+	return withdrawn, nil
+}
 
-	var withdrawn float32
-	for _, withdrawal := range withdrawals {
-		withdrawn += withdrawal.Amount
+// GetBalanceSummary builds the balance of the user with one aggregate query per table
+// instead of loading the orders and withdrawals.
+func (dbStorage DBStorage) GetBalanceSummary(login string, ctx context.Context) (service.Balance, error) {
+	balance := service.Balance{Login: login}
+
+	var user service.User
+	err := dbStorage.db.WithContext(ctx).Where("login  = 	?", login).First(&user).Error
+	if err != nil {
+		return balance, err
+	}
+	balance.Current = user.Balance
+	if user.Balance > 0 {
+		balance.Available = user.Balance
 	}
 
-	return withdrawn, nil
+	var orders struct {
+		Pending        int64
+		LifetimeEarned float32
+	}
+	err = dbStorage.db.WithContext(ctx).Model(&service.Order{}).
+		Select("count(*) filter (where status in ?) as pending, "+
+			"coalesce(sum(accrual) filter (where status = ?), 0) as lifetime_earned",
+			[]string{NEW, REGISTERED, PROCESSING}, PROCESSED).
+		Where("login = ?", login).Scan(&orders).Error
+	if err != nil {
+		return balance, err
+	}
+	balance.Pending = orders.Pending
+	balance.LifetimeEarned = orders.LifetimeEarned
+
+	balance.Withdrawn, err = dbStorage.GetWithdrawnAmount(login, ctx)
+	if err != nil {
+		return balance, err
+	}
+	return balance, nil
 }
 
 func (dbStorage DBStorage) GetWithdrawals(login string, ctx context.Context) ([]service.Withdrawal, error) {
@@ -204,8 +432,77 @@ func (dbStorage DBStorage) GetWithdrawals(login string, ctx context.Context) ([]
 	return withdrawals, nil
 }
 
+// ReverseWithdrawal returns the withdrawn points to the user and keeps the withdrawal
+// in the history marked as reversed.
+func (dbStorage DBStorage) ReverseWithdrawal(orderID service.OrderNumber, reason string, ctx context.Context) (service.Withdrawal, error) {
+	if err := requireTenant(ctx); err != nil {
+		return service.Withdrawal{}, err
+	}
+	var withdrawal service.Withdrawal
+	err := dbStorage.inTx(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("order_id = ?", orderID).First(&withdrawal).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrWithdrawalNotFound
+			}
+			return err
+		}
+
+		user, err := lockUser(tx, withdrawal.Login)
+		if err != nil {
+			return err
+		}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_id = ?", orderID).First(&withdrawal).Error
+		if err != nil {
+			return err
+		}
+		if withdrawal.Status == WithdrawalReversed {
+			return ErrAlreadyReversed
+		}
+
+		reversedAt := time.Now()
+		withdrawal.Status = WithdrawalReversed
+		withdrawal.ReversedAt = &reversedAt
+		withdrawal.ReversalReason = reason
+		err = tx.Model(&withdrawal).Select("status", "reversed_at", "reversal_reason").Updates(&withdrawal).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Unscoped().Model(&service.User{}).Where("login = ?", withdrawal.Login).
+			Update("balance", gorm.Expr("balance + ?", withdrawal.Amount)).Error
+		if err != nil {
+			return err
+		}
+		err = dbStorage.creditLot(tx, withdrawal.Login, withdrawal.OrderID, withdrawal.Amount, HistoryReversal)
+		if err != nil {
+			return err
+		}
+		return addEvent(tx, service.EventWithdrawalReversed, withdrawal.Login, service.WithdrawalReversed{
+			Login: withdrawal.Login, Number: withdrawal.OrderID, Amount: withdrawal.Amount, Reason: reason,
+			Balance: user.Balance + withdrawal.Amount,
+		})
+	})
+	if err != nil {
+		return service.Withdrawal{}, err
+	}
+	return withdrawal, nil
+}
+
 func (dbStorage DBStorage) DeleteAll() {
 	dbStorage.db.Exec("DELETE FROM users")
 	dbStorage.db.Exec("DELETE FROM orders")
 	dbStorage.db.Exec("DELETE FROM withdrawals")
+	dbStorage.db.Exec("DELETE FROM password_reset_tokens")
+	dbStorage.db.Exec("DELETE FROM chargebacks")
+	dbStorage.db.Exec("DELETE FROM point_lots")
+	dbStorage.db.Exec("DELETE FROM point_expiries")
+	dbStorage.db.Exec("DELETE FROM idempotency_keys")
+	dbStorage.db.Exec("DELETE FROM outbox_events")
+	dbStorage.db.Exec("DELETE FROM webhook_attempts")
+	dbStorage.db.Exec("DELETE FROM webhook_deliveries")
+	dbStorage.db.Exec("DELETE FROM webhook_subscriptions")
+	dbStorage.db.Exec("DELETE FROM rate_limit_buckets")
+	dbStorage.db.Exec("DELETE FROM order_claims")
+	dbStorage.db.Exec("DELETE FROM tenants WHERE id <> ?", service.DefaultTenantID)
 }
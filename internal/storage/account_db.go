@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"time"
+)
+
+func (dbStorage DBStorage) GetSessionVersion(login string, ctx context.Context) (int, error) {
+	var user service.User
+	err := dbStorage.db.WithContext(ctx).Where("login = ?", login).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	return user.SessionVersion, nil
+}
+
+func (dbStorage DBStorage) UpdateProfile(login string, update service.ProfileUpdate, ctx context.Context) (service.Profile, error) {
+	var profile service.Profile
+	err := dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user service.User
+		err := tx.Where("login = ?", login).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		if update.Name != nil {
+			user.Name = *update.Name
+		}
+		if update.Login != nil && *update.Login != user.Login {
+			var count int64
+			err = tx.Unscoped().Model(&service.User{}).Where("login = ?", *update.Login).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count != 0 {
+				return ErrUserExists
+			}
+			err = renameLogin(tx, user.Login, *update.Login)
+			if err != nil {
+				return err
+			}
+			user.Login = *update.Login
+		}
+
+		err = tx.Model(&user).Select("name", "login").Updates(&user).Error
+		if err != nil {
+			return err
+		}
+		profile = service.Profile{Login: user.Login, Name: user.Name}
+		return nil
+	})
+	if isUniqueViolation(err) {
+		// a concurrent rename took the login after it was checked
+		return service.Profile{}, ErrUserExists
+	}
+	return profile, err
+}
+
+func (dbStorage DBStorage) ChangePassword(login string, change service.PasswordChange, ctx context.Context) (int, error) {
+	var user service.User
+	err := dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("login = ?", login).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		if !service.CheckPasswordHash(change.CurrentPassword, user.Password) {
+			return ErrInvalidCredentials
+		}
+
+		hashedPassword, err := service.GeneratePasswordHash(change.NewPassword)
+		if err != nil {
+			return fmt.Errorf("error in password hashing: %s", err)
+		}
+		user.Password = hashedPassword
+		user.SessionVersion++
+		return tx.Model(&user).Select("password", "session_version").Updates(&user).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return user.SessionVersion, nil
+}
+
+// DeleteUser anonymises the account instead of dropping it, so that orders and withdrawals
+// stay in the database for accounting under a login that no longer identifies the person.
+func (dbStorage DBStorage) DeleteUser(login string, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user service.User
+		err := tx.Where("login = ?", login).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		anonymousLogin := fmt.Sprintf("deleted-%d", user.ID)
+		err = renameLogin(tx, user.Login, anonymousLogin)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&user).Updates(map[string]interface{}{
+			"login":           anonymousLogin,
+			"name":            "",
+			"password":        "",
+			"session_version": user.SessionVersion + 1,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+}
+
+func (dbStorage DBStorage) CreatePasswordResetToken(login string, tokenHash string, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var user service.User
+		err := tx.Where("login = ?", login).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrUserNotFound
+			}
+			return err
+		}
+
+		var recentRequests int64
+		err = tx.Model(&service.PasswordResetToken{}).
+			Where("user_id = ? AND created_at > ?", user.ID, time.Now().Add(-dbStorage.settings.ResetRequestWindow)).
+			Count(&recentRequests).Error
+		if err != nil {
+			return err
+		}
+		if recentRequests >= int64(dbStorage.settings.ResetRequestLimit) {
+			return ErrTooManyResetRequests
+		}
+
+		token := service.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: tokenHash,
+			ExpiresAt: time.Now().Add(dbStorage.settings.ResetTokenTTL),
+		}
+		return tx.Create(&token).Error
+	})
+}
+
+// ResetPassword sets a new password for the owner of a valid reset token, burns every
+// outstanding token of the user and revokes all of their sessions.
+func (dbStorage DBStorage) ResetPassword(tokenHash string, password string, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var token service.PasswordResetToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, time.Now()).
+			First(&token).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+
+		var user service.User
+		err = tx.First(&user, token.UserID).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+
+		hashedPassword, err := service.GeneratePasswordHash(password)
+		if err != nil {
+			return fmt.Errorf("error in password hashing: %s", err)
+		}
+		err = tx.Model(&user).Updates(map[string]interface{}{
+			"password":        hashedPassword,
+			"session_version": user.SessionVersion + 1,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&service.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.ID).Update("used_at", time.Now()).Error
+	})
+}
+
+// renameLogin moves the balance history, the events and the idempotency keys of a user to a new login.
+func renameLogin(tx *gorm.DB, oldLogin, newLogin string) error {
+	models := []interface{}{
+		&service.Order{}, &service.Withdrawal{}, &service.Chargeback{}, &service.PointLot{}, &service.PointExpiry{},
+		&service.OutboxEvent{}, &service.IdempotencyKey{},
+	}
+	for _, model := range models {
+		err := tx.Model(model).Where("login = ?", oldLogin).Update("login", newLogin).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
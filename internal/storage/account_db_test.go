@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestUpdateProfileRenameRace renames several users to one login at once, one rename wins
+// and the others get ErrUserExists instead of the unique index error.
+func TestUpdateProfileRenameRace(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	const users = 4
+	newLogin := fmt.Sprintf("renamed-%d", time.Now().UnixNano())
+	var logins []string
+	for i := 0; i < users; i++ {
+		login := fmt.Sprintf("rename-%d-%d", i, time.Now().UnixNano())
+		require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+		logins = append(logins, login)
+	}
+
+	errs := make([]error, users)
+	var wg sync.WaitGroup
+	for i, login := range logins {
+		wg.Add(1)
+		go func(i int, login string) {
+			defer wg.Done()
+			_, errs[i] = userStorage.UpdateProfile(login, service.ProfileUpdate{Login: &newLogin}, ctx)
+		}(i, login)
+	}
+	wg.Wait()
+
+	renamed := 0
+	for _, err := range errs {
+		if err == nil {
+			renamed++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrUserExists)
+	}
+	assert.Equal(t, 1, renamed)
+}
+
+func TestUpdateProfileRenameMovesKeys(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{IdempotencyKeyTTL: time.Hour})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	login := fmt.Sprintf("rename-%d", time.Now().UnixNano())
+	require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+	record := service.IdempotencyKey{Login: login, Key: "never-gonna-turn-around", Fingerprint: "rickroll"}
+	_, created, err := userStorage.ReserveIdempotencyKey(record, ctx)
+	require.NoError(t, err)
+	require.True(t, created)
+
+	newLogin := login + "-renamed"
+	_, err = userStorage.UpdateProfile(login, service.ProfileUpdate{Login: &newLogin}, ctx)
+	require.NoError(t, err)
+
+	record.Login = newLogin
+	_, created, err = userStorage.ReserveIdempotencyKey(record, ctx)
+	require.NoError(t, err)
+	assert.False(t, created, "the key stored under the old login still matches")
+
+	var events int64
+	require.NoError(t, userStorage.db.Model(&service.OutboxEvent{}).Where("login = ?", login).Count(&events).Error)
+	assert.Zero(t, events, "the events are moved to the new login")
+}
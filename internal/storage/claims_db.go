@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// claimOrderNumber reserves the number for an order or a withdrawal of the tenant bound to tx.
+// A number claimed before is refused with the error telling what it is already used for.
+func claimOrderNumber(tx *gorm.DB, number service.OrderNumber, kind string, login string) error {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&service.OrderClaim{Number: number, Kind: kind})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 1 {
+		return nil
+	}
+
+	var claim service.OrderClaim
+	err := tx.Where("number = ?", number).First(&claim).Error
+	if err != nil {
+		return err
+	}
+	switch {
+	case claim.Kind == ClaimWithdrawal:
+		return ErrAlreadyWithdrawn
+	case kind == ClaimWithdrawal:
+		return ErrOrderNumberUploaded
+	}
+
+	var order service.Order
+	err = tx.Where("number = ?", number).First(&order).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if order.Login == login {
+		return ErrAlreadyExists
+	}
+	return ErrUploadedByAnotherUser
+}
+
+// claimNewOrders claims the numbers of the new orders of a batch. The numbers claimed concurrently
+// by another upload or a withdrawal are skipped, reported through lost and left out of the returned orders.
+// The insert waits for the concurrent claims to commit, so their orders and claims are visible afterwards.
+func claimNewOrders(tx *gorm.DB, login string, orders []service.Order,
+	lost func(number service.OrderNumber, result string)) ([]service.Order, error) {
+	claims := make([]service.OrderClaim, len(orders))
+	numbers := make([]service.OrderNumber, len(orders))
+	for i, order := range orders {
+		claims[i] = service.OrderClaim{Number: order.Number, Kind: ClaimOrder}
+		numbers[i] = order.Number
+	}
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&claims)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == int64(len(claims)) {
+		return orders, nil
+	}
+
+	taken := make(map[service.OrderNumber]bool)
+	var withdrawalClaims []service.OrderClaim
+	err := tx.Where("number IN ? AND kind = ?", numbers, ClaimWithdrawal).Find(&withdrawalClaims).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, claim := range withdrawalClaims {
+		taken[claim.Number] = true
+		lost(claim.Number, UploadUsedForWithdraw)
+	}
+	var uploaded []service.Order
+	err = tx.Where("number IN ?", numbers).Find(&uploaded).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range uploaded {
+		taken[order.Number] = true
+		if order.Login == login {
+			lost(order.Number, UploadAlreadyUploaded)
+		} else {
+			lost(order.Number, UploadedByAnotherUser)
+		}
+	}
+
+	claimed := orders[:0]
+	for _, order := range orders {
+		if !taken[order.Number] {
+			claimed = append(claimed, order)
+		}
+	}
+	return claimed, nil
+}
+
+// migrateOrderClaims claims the numbers of the orders and withdrawals made before the claims.
+// A number used for both keeps the claim of the order.
+func migrateOrderClaims(connection *gorm.DB) error {
+	err := connection.Exec(`INSERT INTO order_claims (tenant_id, number, kind, created_at)
+		SELECT tenant_id, number, ?, uploaded_at FROM orders ON CONFLICT DO NOTHING`, ClaimOrder).Error
+	if err != nil {
+		return err
+	}
+	return connection.Exec(`INSERT INTO order_claims (tenant_id, number, kind, created_at)
+		SELECT tenant_id, order_id, ?, processed_at FROM withdrawals ON CONFLICT DO NOTHING`, ClaimWithdrawal).Error
+}
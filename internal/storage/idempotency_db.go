@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"context"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// ReserveIdempotencyKey stores the key unless it is already known. It returns the stored record
+// and whether it was created by this call.
+func (dbStorage DBStorage) ReserveIdempotencyKey(record service.IdempotencyKey, ctx context.Context) (service.IdempotencyKey, bool, error) {
+	created := false
+	err := dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("login = ? AND key = ? AND created_at < ?",
+			record.Login, record.Key, time.Now().Add(-dbStorage.settings.IdempotencyKeyTTL)).
+			Delete(&service.IdempotencyKey{}).Error
+		if err != nil {
+			return err
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			created = true
+			return nil
+		}
+		return tx.Where("login = ? AND key = ?", record.Login, record.Key).First(&record).Error
+	})
+	if err != nil {
+		return service.IdempotencyKey{}, false, err
+	}
+	return record, created, nil
+}
+
+func (dbStorage DBStorage) SaveIdempotentResponse(record service.IdempotencyKey, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Model(&record).
+		Select("status_code", "content_type", "body").Updates(&record).Error
+}
+
+func (dbStorage DBStorage) ReleaseIdempotencyKey(login string, key string, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Where("login = ? AND key = ?", login, key).
+		Delete(&service.IdempotencyKey{}).Error
+}
+
+func (dbStorage DBStorage) DeleteExpiredIdempotencyKeys(before time.Time, ctx context.Context) (int64, error) {
+	result := dbStorage.db.WithContext(ctx).Where("created_at < ?", before).Delete(&service.IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
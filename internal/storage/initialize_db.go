@@ -1,18 +1,49 @@
 package storage
 
 import (
+	"gophermart/internal/policy"
 	"gophermart/internal/service"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 	"log"
+	"time"
 )
 
 type DBStorage struct {
-	db *gorm.DB
+	db          *gorm.DB
+	databaseURL string
+	settings    Settings
 }
 
-func NewUserStorage(DatabaseURL string) *DBStorage {
-	connection, err := gorm.Open(postgres.Open(DatabaseURL), &gorm.Config{})
+// Settings holds the storage level business rules taken from the config.
+type Settings struct {
+	ResetTokenTTL      time.Duration
+	ResetRequestLimit  int
+	ResetRequestWindow time.Duration
+
+	// AllowNegativeBalance lets chargebacks debit more points than the user has left.
+	AllowNegativeBalance bool
+	// PointsExpiryMonths is the lifetime of credited points, zero keeps them forever.
+	PointsExpiryMonths int
+	// IdempotencyKeyTTL is how long a stored response can be replayed.
+	IdempotencyKeyTTL time.Duration
+	// WithdrawalRules limit the withdrawal amounts, zero limits are off.
+	WithdrawalRules policy.WithdrawalRules
+
+	// Pool limits, zero values keep the database/sql defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	// LogLevel is the config log level, debug logs every SQL statement.
+	LogLevel string
+}
+
+func NewUserStorage(DatabaseURL string, settings Settings) *DBStorage {
+	connection, err := gorm.Open(postgres.Open(DatabaseURL), &gorm.Config{
+		Logger: logger.Default.LogMode(gormLogLevel(settings.LogLevel)),
+	})
 	if err != nil {
 		log.Fatalf("database failed to open: %s", err)
 	}
@@ -20,6 +51,18 @@ func NewUserStorage(DatabaseURL string) *DBStorage {
 	if err != nil {
 		log.Fatalf("database failed to connect: %s", err)
 	}
+	if settings.MaxOpenConns != 0 {
+		sqlDB.SetMaxOpenConns(settings.MaxOpenConns)
+	}
+	if settings.MaxIdleConns != 0 {
+		sqlDB.SetMaxIdleConns(settings.MaxIdleConns)
+	}
+	if settings.ConnMaxLifetime != 0 {
+		sqlDB.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	}
+	if settings.ConnMaxIdleTime != 0 {
+		sqlDB.SetConnMaxIdleTime(settings.ConnMaxIdleTime)
+	}
 
 	err = sqlDB.Ping()
 	if err != nil {
@@ -28,14 +71,35 @@ func NewUserStorage(DatabaseURL string) *DBStorage {
 	log.Printf("Database connection successful")
 
 	InitializeTables(connection)
+	err = registerTenantScope(connection)
+	if err != nil {
+		log.Fatalf("database failed to register tenant scope: %s", err)
+	}
 
 	return &DBStorage{
-		db: connection,
+		db:          connection,
+		databaseURL: DatabaseURL,
+		settings:    settings,
+	}
+}
+
+func gormLogLevel(level string) logger.LogLevel {
+	switch level {
+	case "debug":
+		return logger.Info
+	case "error":
+		return logger.Error
+	default:
+		return logger.Warn
 	}
 }
 
 func InitializeTables(connection *gorm.DB) {
-	err := connection.AutoMigrate(service.User{})
+	err := connection.AutoMigrate(service.Tenant{})
+	if err != nil {
+		log.Fatalf("database failed to create tenant table: %s", err)
+	}
+	err = connection.AutoMigrate(service.User{})
 	if err != nil {
 		log.Fatalf("database failed to create user table: %s", err)
 	}
@@ -47,4 +111,44 @@ func InitializeTables(connection *gorm.DB) {
 	if err != nil {
 		log.Fatalf("database failed to create withdrawal table: %s", err)
 	}
+	err = connection.AutoMigrate(service.PasswordResetToken{})
+	if err != nil {
+		log.Fatalf("database failed to create password reset token table: %s", err)
+	}
+	err = connection.AutoMigrate(service.Chargeback{})
+	if err != nil {
+		log.Fatalf("database failed to create chargeback table: %s", err)
+	}
+	err = connection.AutoMigrate(service.PointLot{}, service.PointExpiry{})
+	if err != nil {
+		log.Fatalf("database failed to create point lot tables: %s", err)
+	}
+	err = connection.AutoMigrate(service.IdempotencyKey{})
+	if err != nil {
+		log.Fatalf("database failed to create idempotency key table: %s", err)
+	}
+	err = connection.AutoMigrate(service.OutboxEvent{})
+	if err != nil {
+		log.Fatalf("database failed to create outbox table: %s", err)
+	}
+	err = connection.AutoMigrate(service.WebhookSubscription{}, service.WebhookDelivery{}, service.WebhookAttempt{})
+	if err != nil {
+		log.Fatalf("database failed to create webhook tables: %s", err)
+	}
+	err = connection.AutoMigrate(service.RateLimitBucket{})
+	if err != nil {
+		log.Fatalf("database failed to create rate limit bucket table: %s", err)
+	}
+	err = migrateTenants(connection)
+	if err != nil {
+		log.Fatalf("database failed to migrate tenant keys: %s", err)
+	}
+	err = connection.AutoMigrate(service.OrderClaim{})
+	if err != nil {
+		log.Fatalf("database failed to create order claim table: %s", err)
+	}
+	err = migrateOrderClaims(connection)
+	if err != nil {
+		log.Fatalf("database failed to claim existing order numbers: %s", err)
+	}
 }
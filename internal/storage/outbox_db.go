@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"gophermart/internal/broker"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+// addEvent puts a domain event into the outbox within the transaction of the change it describes.
+func addEvent(tx *gorm.DB, eventType string, login string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	event := service.OutboxEvent{
+		Type:    eventType,
+		Login:   login,
+		Payload: string(body),
+	}
+	err = tx.Create(&event).Error
+	if err != nil {
+		return err
+	}
+	if event.TenantID == "" {
+		event.TenantID = service.DefaultTenantID
+	}
+	// the notification is sent by postgres on commit, so listeners never see a rolled back event
+	err = tx.Exec("SELECT pg_notify(?, ?)", EventsChannel, broker.Key(event.TenantID, login)).Error
+	if err != nil {
+		return err
+	}
+	return enqueueWebhooks(tx, event)
+}
+
+// GetUserEvents returns the events of the given types that happened to the user after the event afterID,
+// and the ones created after since but not in exclude. Ids are taken from a sequence before the
+// commit, so an event may become visible after events with higher ids, and since lets a reader catch it.
+func (dbStorage DBStorage) GetUserEvents(login string, afterID uint, since time.Time, exclude []uint, types []string,
+	limit int, ctx context.Context) ([]service.OutboxEvent, error) {
+	var events []service.OutboxEvent
+	query := dbStorage.db.WithContext(ctx).Where("login = ? AND type IN ?", login, types).
+		Where("id > ? OR created_at > ?", afterID, since)
+	if len(exclude) != 0 {
+		query = query.Where("id NOT IN ?", exclude)
+	}
+	err := query.Order("id asc").Limit(limit).Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (dbStorage DBStorage) GetLastEventID(ctx context.Context) (uint, error) {
+	var lastID uint
+	err := dbStorage.db.WithContext(ctx).Model(&service.OutboxEvent{}).Select("coalesce(max(id), 0)").
+		Scan(&lastID).Error
+	return lastID, err
+}
+
+// ListenEvents calls notify with the broker key of every user that gets a new event on any instance,
+// until ctx is done or the connection breaks.
+func (dbStorage DBStorage) ListenEvents(ctx context.Context, notify func(key string)) error {
+	conn, err := pgx.Connect(ctx, dbStorage.databaseURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+EventsChannel)
+	if err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		notify(notification.Payload)
+	}
+}
+
+// eventLease is how long a relay owns the events it claimed. The events of a relay that died
+// before marking them are claimed again once the lease runs out.
+const eventLease = time.Minute
+
+// GetUnpublishedEvents claims a batch of unpublished events for the relay of this instance.
+// The rows are picked with FOR UPDATE SKIP LOCKED and leased, so the relays of several
+// instances take different events instead of publishing each one twice.
+func (dbStorage DBStorage) GetUnpublishedEvents(limit int, ctx context.Context) ([]service.OutboxEvent, error) {
+	var events []service.OutboxEvent
+	now := time.Now()
+	err := dbStorage.db.WithContext(ctx).Raw(`UPDATE outbox_events SET locked_until = ?
+		WHERE id IN (SELECT id FROM outbox_events
+			WHERE published_at IS NULL AND (locked_until IS NULL OR locked_until < ?)
+			ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED)
+		RETURNING *`, now.Add(eventLease), now, limit).Scan(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+func (dbStorage DBStorage) MarkEventPublished(id uint, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Model(&service.OutboxEvent{}).Where("id = ?", id).
+		Update("published_at", time.Now()).Error
+}
+
+func (dbStorage DBStorage) MarkEventFailed(id uint, reason string, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Model(&service.OutboxEvent{}).Where("id = ?", id).
+		Updates(map[string]interface{}{
+			"attempts":     gorm.Expr("attempts + 1"),
+			"last_error":   reason,
+			"locked_until": nil,
+		}).Error
+}
+
+// ReleaseEvents gives up the lease of claimed events the relay did not get to publish.
+func (dbStorage DBStorage) ReleaseEvents(ids []uint, ctx context.Context) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return dbStorage.db.WithContext(ctx).Model(&service.OutboxEvent{}).Where("id IN ? AND published_at IS NULL", ids).
+		Update("locked_until", nil).Error
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestGetUnpublishedEventsClaims runs the relays of several instances at once, every event goes to one of them.
+func TestGetUnpublishedEventsClaims(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := context.Background()
+
+	const events = 100
+	err := userStorage.db.Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < events; i++ {
+			err := addEvent(tx, service.EventUserRegistered, "claims", service.UserRegistered{Login: "claims"})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	claimed := make(map[uint]int)
+	var wg sync.WaitGroup
+	for relay := 0; relay < 4; relay++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				batch, err := userStorage.GetUnpublishedEvents(10, ctx)
+				if !assert.NoError(t, err) || len(batch) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, event := range batch {
+					claimed[event.ID]++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, claimed, events)
+	for id, count := range claimed {
+		assert.Equal(t, 1, count, "event %d", id)
+	}
+}
+
+func TestReleaseEvents(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := context.Background()
+
+	err := userStorage.db.Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < 3; i++ {
+			err := addEvent(tx, service.EventUserRegistered, "release", service.UserRegistered{Login: "release"})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	batch, err := userStorage.GetUnpublishedEvents(10, ctx)
+	require.NoError(t, err)
+	require.Len(t, batch, 3)
+	require.NoError(t, userStorage.MarkEventPublished(batch[0].ID, ctx))
+	require.NoError(t, userStorage.MarkEventFailed(batch[1].ID, "sink is down", ctx))
+	require.NoError(t, userStorage.ReleaseEvents([]uint{batch[2].ID}, ctx))
+
+	retried, err := userStorage.GetUnpublishedEvents(10, ctx)
+	require.NoError(t, err)
+	require.Len(t, retried, 2, "the failed event and the rest of the batch are claimed again at once")
+	assert.Equal(t, batch[1].ID, retried[0].ID)
+	assert.Equal(t, batch[2].ID, retried[1].ID)
+}
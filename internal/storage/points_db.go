@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"sort"
+	"time"
+)
+
+func (dbStorage DBStorage) creditLot(tx *gorm.DB, login string, number service.OrderNumber, amount float32, source string) error {
+	if amount <= 0 {
+		return nil
+	}
+	lot := service.PointLot{
+		Login:       login,
+		OrderNumber: number,
+		Source:      source,
+		Amount:      amount,
+		Remaining:   amount,
+		CreditedAt:  time.Now(),
+	}
+	if dbStorage.settings.PointsExpiryMonths > 0 {
+		expiresAt := lot.CreditedAt.AddDate(0, dbStorage.settings.PointsExpiryMonths, 0)
+		lot.ExpiresAt = &expiresAt
+	}
+	return tx.Create(&lot).Error
+}
+
+// consumeLots takes amount out of the lots of the user, the lot of preferredOrder first
+// and then the ones closest to expiry. Points credited before lots existed are not tracked,
+// so running out of lots is not an error.
+func consumeLots(tx *gorm.DB, login string, amount float32, preferredOrder service.OrderNumber) error {
+	var lots []service.PointLot
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("login = ? AND remaining > 0", login).
+		Order("expires_at asc nulls last").Order("credited_at asc").
+		Find(&lots).Error
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(lots, func(i, j int) bool {
+		return lots[i].OrderNumber == preferredOrder && lots[j].OrderNumber != preferredOrder
+	})
+
+	for _, lot := range lots {
+		if amount <= 0 {
+			break
+		}
+		taken := lot.Remaining
+		if taken > amount {
+			taken = amount
+		}
+		err = tx.Model(&lot).Update("remaining", lot.Remaining-taken).Error
+		if err != nil {
+			return err
+		}
+		amount -= taken
+	}
+	return nil
+}
+
+// ExpirePoints writes off what is left of every lot expired by now and returns the expiry records
+// with the points actually debited.
+// Each lot is expired in its own transaction, so a busy user does not hold up the others,
+// and a lot that fails is logged and left for the next run.
+func (dbStorage DBStorage) ExpirePoints(now time.Time, ctx context.Context) ([]service.PointExpiry, error) {
+	var lots []service.PointLot
+	err := dbStorage.db.WithContext(ctx).Where("expires_at <= ? AND remaining > 0", now).Find(&lots).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []service.PointExpiry
+	for _, lot := range lots {
+		var expiry service.PointExpiry
+		err = dbStorage.inTx(tenantContext(ctx, lot.TenantID), func(tx *gorm.DB) error {
+			user, err := lockUser(tx, lot.Login)
+			if err != nil {
+				return err
+			}
+			err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&lot, lot.ID).Error
+			if err != nil {
+				return err
+			}
+			if lot.Remaining <= 0 {
+				return nil
+			}
+
+			// the balance may hold less than the lot, the rest is recorded as unrecovered like in chargebacks
+			debit := lot.Remaining
+			if debit > user.Balance {
+				debit = user.Balance
+				if debit < 0 {
+					debit = 0
+				}
+			}
+			if debit > 0 {
+				err = tx.Unscoped().Model(&user).Update("balance", gorm.Expr("balance - ?", debit)).Error
+				if err != nil {
+					return err
+				}
+			}
+
+			err = tx.Model(&lot).Update("remaining", 0).Error
+			if err != nil {
+				return err
+			}
+			expiry = service.PointExpiry{
+				Login:       lot.Login,
+				LotID:       lot.ID,
+				OrderNumber: lot.OrderNumber,
+				Amount:      debit,
+				Unrecovered: lot.Remaining - debit,
+				ExpiredAt:   now,
+			}
+			err = tx.Create(&expiry).Error
+			if err != nil {
+				return err
+			}
+			return addEvent(tx, service.EventPointsExpired, lot.Login, service.PointsExpired{
+				Login: lot.Login, Number: lot.OrderNumber, Amount: debit, Balance: user.Balance - debit,
+			})
+		})
+		if err != nil {
+			log.Printf("expire points: %s for lot: %d", err, lot.ID)
+			continue
+		}
+		if expiry.ID != 0 {
+			expired = append(expired, expiry)
+		}
+	}
+	return expired, nil
+}
+
+func (dbStorage DBStorage) GetExpiringPoints(login string, before time.Time, ctx context.Context) (float32, error) {
+	var expiring float32
+	err := dbStorage.db.WithContext(ctx).Model(&service.PointLot{}).
+		Select("coalesce(sum(remaining), 0)").
+		Where("login = ? AND remaining > 0 AND expires_at <= ?", login, before).
+		Scan(&expiring).Error
+	if err != nil {
+		return 0, err
+	}
+	return expiring, nil
+}
+
+// GetBalanceHistory lists every movement of the balance of the user from the oldest to the newest.
+func (dbStorage DBStorage) GetBalanceHistory(login string, ctx context.Context) ([]service.HistoryEntry, error) {
+	db := dbStorage.db.WithContext(ctx)
+	var history []service.HistoryEntry
+
+	var lots []service.PointLot
+	err := db.Where("login = ?", login).Find(&lots).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, lot := range lots {
+		history = append(history, service.HistoryEntry{
+			Type: lot.Source, Order: lot.OrderNumber, Amount: lot.Amount, At: lot.CreditedAt,
+		})
+	}
+
+	var withdrawals []service.Withdrawal
+	err = db.Where("login = ?", login).Find(&withdrawals).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, withdrawal := range withdrawals {
+		history = append(history, service.HistoryEntry{
+			Type: HistoryWithdrawal, Order: withdrawal.OrderID, Amount: -withdrawal.Amount, At: withdrawal.ProcessedAt,
+		})
+	}
+
+	var chargebacks []service.Chargeback
+	err = db.Where("login = ?", login).Find(&chargebacks).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, chargeback := range chargebacks {
+		history = append(history, service.HistoryEntry{
+			Type:   HistoryChargeback,
+			Order:  chargeback.OrderNumber,
+			Amount: -(chargeback.Amount - chargeback.Unrecovered),
+			At:     chargeback.CreatedAt,
+		})
+	}
+
+	var expiries []service.PointExpiry
+	err = db.Where("login = ?", login).Find(&expiries).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, expiry := range expiries {
+		history = append(history, service.HistoryEntry{
+			Type: HistoryExpiry, Order: expiry.OrderNumber, Amount: -expiry.Amount, At: expiry.ExpiredAt,
+		})
+	}
+
+	if len(history) == 0 {
+		return nil, ErrHistoryEmpty
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].At.Before(history[j].At)
+	})
+	return history, nil
+}
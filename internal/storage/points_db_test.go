@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExpirePointsOverBalance(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{PointsExpiryMonths: 1})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	login := fmt.Sprintf("expiry-%d", time.Now().UnixNano())
+	require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+	number := luhnNumbers(1)[0]
+	require.NoError(t, userStorage.PutOrder(service.Order{Number: number, Login: login}, ctx))
+	require.NoError(t, userStorage.UpdateOrderStatus(service.Order{
+		TenantID: service.DefaultTenantID, Number: number, Login: login, Status: PROCESSED, Accrual: 100,
+	}, ctx))
+	// the balance went below the lot on a path that does not track lots
+	require.NoError(t, userStorage.db.Model(&service.User{}).Where("login = ?", login).Update("balance", 30).Error)
+
+	expired, err := userStorage.ExpirePoints(time.Now().AddDate(0, 2, 0), ctx)
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, float32(30), expired[0].Amount, "only the points left on the balance are debited")
+	assert.Equal(t, float32(70), expired[0].Unrecovered)
+
+	balance, err := userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Zero(t, balance)
+
+	history, err := userStorage.GetBalanceHistory(login, ctx)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, HistoryExpiry, history[1].Type)
+	assert.Equal(t, float32(-30), history[1].Amount)
+}
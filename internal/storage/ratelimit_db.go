@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"time"
+)
+
+// availableTokens is the content of a bucket refilled for the time since its last request.
+const availableTokens = `LEAST(@requests::float8, bucket.tokens +
+	GREATEST(EXTRACT(EPOCH FROM @now::timestamptz - bucket.updated_at)::float8, 0) * @rate::float8)`
+
+// TakeRateLimitToken refills the bucket and takes a token in a single upsert, so that concurrent
+// requests of every instance are counted against the same bucket without a lost update.
+func (dbStorage DBStorage) TakeRateLimitToken(key string, requests int, period time.Duration, now time.Time,
+	ctx context.Context) (float64, bool, error) {
+	var bucket service.RateLimitBucket
+	err := dbStorage.db.WithContext(ctx).Raw(`INSERT INTO rate_limit_buckets AS bucket (key, tokens, allowed, updated_at)
+		VALUES (@key, @requests::float8 - 1, true, @now)
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE WHEN `+availableTokens+` >= 1 THEN `+availableTokens+` - 1 ELSE `+availableTokens+` END,
+			allowed = `+availableTokens+` >= 1,
+			updated_at = @now
+		RETURNING tokens, allowed`, map[string]interface{}{
+		"key":      key,
+		"requests": requests,
+		"rate":     float64(requests) / period.Seconds(),
+		"now":      now,
+	}).Scan(&bucket).Error
+	if err != nil {
+		return 0, false, err
+	}
+	return bucket.Tokens, bucket.Allowed, nil
+}
+
+// RefundRateLimitToken puts a token back into the bucket, up to its capacity. updated_at is kept,
+// the refill since the last request is still owed to the bucket.
+func (dbStorage DBStorage) RefundRateLimitToken(key string, requests int, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Model(&service.RateLimitBucket{}).Where("key = ?", key).
+		UpdateColumn("tokens", gorm.Expr("LEAST(tokens + 1, ?::float8)", requests)).Error
+}
+
+// DeleteStaleRateLimitBuckets drops the buckets idle since before, they would be full again anyway.
+func (dbStorage DBStorage) DeleteStaleRateLimitBuckets(before time.Time, ctx context.Context) (int64, error) {
+	result := dbStorage.db.WithContext(ctx).Where("updated_at < ?", before).Delete(&service.RateLimitBucket{})
+	return result.RowsAffected, result.Error
+}
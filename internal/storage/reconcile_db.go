@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// GetOrdersToReconcile returns processed orders, the ones reconciled longest ago first.
+func (dbStorage DBStorage) GetOrdersToReconcile(limit int, ctx context.Context) ([]service.Order, error) {
+	var orders []service.Order
+	err := dbStorage.db.WithContext(ctx).Where("status = ?", PROCESSED).
+		Order("reconciled_at asc nulls first").Limit(limit).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (dbStorage DBStorage) MarkOrderReconciled(number service.OrderNumber, ctx context.Context) error {
+	if err := requireTenant(ctx); err != nil {
+		return err
+	}
+	return dbStorage.db.WithContext(ctx).Model(&service.Order{}).Where("number = ?", number).
+		Update("reconciled_at", time.Now()).Error
+}
+
+// ChargeBack lowers the accrual of a processed order and debits the difference from its owner.
+// Unless negative balances are allowed, the debit stops at zero and the rest is recorded as unrecovered.
+func (dbStorage DBStorage) ChargeBack(number service.OrderNumber, accrual float32, status string, ctx context.Context) (service.Chargeback, error) {
+	if err := requireTenant(ctx); err != nil {
+		return service.Chargeback{}, err
+	}
+	var chargeback service.Chargeback
+	err := dbStorage.inTx(ctx, func(tx *gorm.DB) error {
+		var order service.Order
+		err := tx.Where("number = ?", number).First(&order).Error
+		if err != nil {
+			return err
+		}
+
+		user, err := lockUser(tx, order.Login)
+		if err != nil {
+			return err
+		}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("number = ?", number).First(&order).Error
+		if err != nil {
+			return err
+		}
+		if order.Status != PROCESSED || accrual >= order.Accrual {
+			return ErrNothingToChargeBack
+		}
+
+		amount := order.Accrual - accrual
+		debit := amount
+		if !dbStorage.settings.AllowNegativeBalance && debit > user.Balance {
+			debit = user.Balance
+			if debit < 0 {
+				debit = 0
+			}
+		}
+
+		err = tx.Model(&order).Where("number = ?", number).Updates(map[string]interface{}{
+			"accrual":       accrual,
+			"status":        status,
+			"reconciled_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Model(&user).Update("balance", gorm.Expr("balance - ?", debit)).Error
+		if err != nil {
+			return err
+		}
+		err = consumeLots(tx, order.Login, debit, number)
+		if err != nil {
+			return err
+		}
+
+		chargeback = service.Chargeback{
+			Login:       order.Login,
+			OrderNumber: number,
+			Amount:      amount,
+			Unrecovered: amount - debit,
+		}
+		err = tx.Create(&chargeback).Error
+		if err != nil {
+			return err
+		}
+		return addEvent(tx, service.EventPointsChargedBack, order.Login, service.PointsChargedBack{
+			Login: order.Login, Number: number, Amount: debit, Unrecovered: chargeback.Unrecovered,
+			Balance: user.Balance - debit,
+		})
+	})
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return service.Chargeback{}, ErrNothingToChargeBack
+		}
+		return service.Chargeback{}, err
+	}
+	return chargeback, nil
+}
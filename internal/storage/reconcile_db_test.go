@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"os"
+	"testing"
+	"time"
+)
+
+// processedOrders registers a user with a processed order of every given accrual.
+func processedOrders(t *testing.T, userStorage *DBStorage, accruals ...float32) (string, []service.OrderNumber) {
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+	login := fmt.Sprintf("reconcile-%d", time.Now().UnixNano())
+	require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+
+	numbers := luhnNumbers(len(accruals))
+	for i, number := range numbers {
+		require.NoError(t, userStorage.PutOrder(service.Order{Number: number, Login: login}, ctx))
+		require.NoError(t, userStorage.UpdateOrderStatus(service.Order{
+			TenantID: service.DefaultTenantID, Number: number, Login: login, Status: PROCESSED, Accrual: accruals[i],
+		}, ctx))
+	}
+	return login, numbers
+}
+
+func TestChargeBack(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	login, numbers := processedOrders(t, userStorage, 100, 50)
+
+	chargeback, err := userStorage.ChargeBack(numbers[0], 60, PROCESSED, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(40), chargeback.Amount, "a lowered accrual is debited by the difference")
+	assert.Zero(t, chargeback.Unrecovered)
+
+	chargeback, err = userStorage.ChargeBack(numbers[1], 0, INVALID, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(50), chargeback.Amount, "an invalid verdict charges back the whole accrual")
+
+	_, err = userStorage.ChargeBack(numbers[0], 60, PROCESSED, ctx)
+	assert.ErrorIs(t, err, ErrNothingToChargeBack)
+
+	balance, err := userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, float32(60), balance)
+
+	orders, err := userStorage.GetOrdersByLogin(login, ctx)
+	require.NoError(t, err)
+	statuses := make(map[service.OrderNumber]service.Order)
+	for _, order := range orders {
+		statuses[order.Number] = order
+	}
+	assert.Equal(t, float32(60), statuses[numbers[0]].Accrual)
+	assert.Equal(t, INVALID, statuses[numbers[1]].Status)
+	assert.Zero(t, statuses[numbers[1]].Accrual)
+}
+
+func TestGetOrdersToReconcileRotates(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	_, numbers := processedOrders(t, userStorage, 10, 20, 30)
+	var seen []service.OrderNumber
+	for range numbers {
+		orders, err := userStorage.GetOrdersToReconcile(1, ctx)
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		seen = append(seen, orders[0].Number)
+		require.NoError(t, userStorage.MarkOrderReconciled(orders[0].Number, ctx))
+	}
+	assert.ElementsMatch(t, numbers, seen, "every order is reconciled once before any is reconciled again")
+
+	orders, err := userStorage.GetOrdersToReconcile(1, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, seen[0], orders[0].Number, "the order reconciled longest ago comes next")
+}
@@ -11,13 +11,58 @@ type UserStorage interface {
 	CheckUserAuth(authDetails service.Authentication, ctx context.Context) error
 	RegisterUser(user service.User, ctx context.Context) error
 	PutOrder(order service.Order, ctx context.Context) error
+	PutOrders(login string, numbers []service.OrderNumber, ctx context.Context) ([]service.OrderUploadResult, error)
 	GetOrdersByLogin(login string, ctx context.Context) ([]service.Order, error)
 	GetBalanceByLogin(login string, ctx context.Context) (float32, error)
 	GetWithdrawnAmount(login string, ctx context.Context) (float32, error)
+	GetBalanceSummary(login string, ctx context.Context) (service.Balance, error)
 	Withdraw(withdrawal service.Withdrawal, ctx context.Context) error
 	GetWithdrawals(login string, ctx context.Context) ([]service.Withdrawal, error)
-	GetOrdersToUpdate() ([]service.Order, error)
-	UpdateOrderStatus(order service.Order) error
+	GetOrdersToUpdate(ctx context.Context) ([]service.Order, error)
+	UpdateOrderStatus(order service.Order, ctx context.Context) error
+	DeferOrderPoll(order service.Order, ctx context.Context) error
+	GetOrder(number service.OrderNumber, ctx context.Context) (service.Order, error)
+	GetSessionVersion(login string, ctx context.Context) (int, error)
+	UpdateProfile(login string, update service.ProfileUpdate, ctx context.Context) (service.Profile, error)
+	ChangePassword(login string, change service.PasswordChange, ctx context.Context) (int, error)
+	DeleteUser(login string, ctx context.Context) error
+	CreatePasswordResetToken(login string, tokenHash string, ctx context.Context) error
+	ResetPassword(tokenHash string, password string, ctx context.Context) error
+	ReverseWithdrawal(orderID service.OrderNumber, reason string, ctx context.Context) (service.Withdrawal, error)
+	GetOrdersToReconcile(limit int, ctx context.Context) ([]service.Order, error)
+	MarkOrderReconciled(number service.OrderNumber, ctx context.Context) error
+	ChargeBack(number service.OrderNumber, accrual float32, status string, ctx context.Context) (service.Chargeback, error)
+	ExpirePoints(now time.Time, ctx context.Context) ([]service.PointExpiry, error)
+	GetExpiringPoints(login string, before time.Time, ctx context.Context) (float32, error)
+	GetBalanceHistory(login string, ctx context.Context) ([]service.HistoryEntry, error)
+	ReserveIdempotencyKey(record service.IdempotencyKey, ctx context.Context) (service.IdempotencyKey, bool, error)
+	SaveIdempotentResponse(record service.IdempotencyKey, ctx context.Context) error
+	ReleaseIdempotencyKey(login string, key string, ctx context.Context) error
+	DeleteExpiredIdempotencyKeys(before time.Time, ctx context.Context) (int64, error)
+	GetUnpublishedEvents(limit int, ctx context.Context) ([]service.OutboxEvent, error)
+	MarkEventPublished(id uint, ctx context.Context) error
+	MarkEventFailed(id uint, reason string, ctx context.Context) error
+	ReleaseEvents(ids []uint, ctx context.Context) error
+	GetUserEvents(login string, afterID uint, since time.Time, exclude []uint, types []string, limit int,
+		ctx context.Context) ([]service.OutboxEvent, error)
+	GetLastEventID(ctx context.Context) (uint, error)
+	ListenEvents(ctx context.Context, notify func(key string)) error
+	CreateWebhook(subscription service.WebhookSubscription, ctx context.Context) (service.WebhookSubscription, error)
+	GetWebhooks(ctx context.Context) ([]service.WebhookSubscription, error)
+	DeleteWebhook(id uint, ctx context.Context) error
+	GetDueWebhookDeliveries(now time.Time, limit int, ctx context.Context) ([]service.WebhookDelivery, error)
+	RecordWebhookAttempt(delivery service.WebhookDelivery, attempt service.WebhookAttempt, ctx context.Context) error
+	GetWebhookAttempts(subscriptionID uint, limit int, ctx context.Context) ([]service.WebhookAttempt, error)
+	GetDeadWebhookDeliveries(ctx context.Context) ([]service.WebhookDelivery, error)
+	RetryWebhookDelivery(id uint, ctx context.Context) error
+	CreateTenant(tenant service.Tenant, ctx context.Context) (service.Tenant, error)
+	GetTenants(ctx context.Context) ([]service.Tenant, error)
+	GetTenant(id string, ctx context.Context) (service.Tenant, error)
+	GetTenantByHost(host string, ctx context.Context) (service.Tenant, error)
+	TakeRateLimitToken(key string, requests int, period time.Duration, now time.Time,
+		ctx context.Context) (float64, bool, error)
+	RefundRateLimitToken(key string, requests int, ctx context.Context) error
+	DeleteStaleRateLimitBuckets(before time.Time, ctx context.Context) (int64, error)
 	DeleteAll()
 }
 
@@ -28,12 +73,66 @@ var (
 	ErrUploadedByAnotherUser = errors.New("this order is uploaded by another user")
 	ErrOrderListEmpty        = errors.New("order list is empty")
 	ErrWithdrawListEmpty     = errors.New("withdraw list is empty")
+	ErrHistoryEmpty          = errors.New("balance history is empty")
 	ErrNotEnoughPoints       = errors.New("not enough accural points")
+	ErrUserNotFound          = errors.New("user not found")
+	ErrTooManyResetRequests  = errors.New("too many password reset requests")
+	ErrInvalidResetToken     = errors.New("reset token is invalid or expired")
+	ErrWithdrawalNotFound    = errors.New("withdrawal not found")
+	ErrAlreadyReversed       = errors.New("withdrawal is already reversed")
+	ErrNothingToChargeBack   = errors.New("accrual has not decreased")
+	ErrWebhookNotFound       = errors.New("webhook not found")
+	ErrTenantNotFound        = errors.New("tenant not found")
+	ErrTenantRequired        = errors.New("context is not bound to a tenant")
+	ErrOrderNotFound         = errors.New("order not found")
+	ErrAlreadyWithdrawn      = errors.New("order number is already used for a withdrawal")
+	ErrOrderNumberUploaded   = errors.New("order number is already uploaded as an accrual order")
 )
 
 const (
-	NEW                = "NEW"
-	REGISTERED         = "REGISTERED"
-	PROCESSING         = "PROCESSING"
-	UPDATEACCURALTIMER = 5 * time.Second
+	NEW           = "NEW"
+	REGISTERED    = "REGISTERED"
+	PROCESSING    = "PROCESSING"
+	PROCESSED     = "PROCESSED"
+	INVALID       = "INVALID"
+	EventsChannel = "gophermart_events"
+)
+
+const (
+	WithdrawalCompleted = "COMPLETED"
+	WithdrawalReversed  = "REVERSED"
+)
+
+const (
+	WebhookPending   = "PENDING"
+	WebhookDelivered = "DELIVERED"
+	WebhookDead      = "DEAD"
+)
+
+const (
+	HistoryAccrual    = "ACCRUAL"
+	HistoryWithdrawal = "WITHDRAWAL"
+	HistoryReversal   = "REVERSAL"
+	HistoryChargeback = "CHARGEBACK"
+	HistoryExpiry     = "EXPIRY"
+)
+
+const (
+	UploadAccepted        = "ACCEPTED"
+	UploadAlreadyUploaded = "ALREADY_UPLOADED"
+	UploadedByAnotherUser = "UPLOADED_BY_ANOTHER_USER"
+	UploadInvalidNumber   = "INVALID"
+	UploadUsedForWithdraw = "USED_FOR_WITHDRAWAL"
+)
+
+const (
+	ClaimOrder      = "ORDER"
+	ClaimWithdrawal = "WITHDRAWAL"
+)
+
+const (
+	PushAccepted      = "ACCEPTED"
+	PushOrderNotFound = "ORDER_NOT_FOUND"
+	PushInvalidStatus = "INVALID_STATUS"
+	PushStaleStatus   = "STALE_STATUS"
 )
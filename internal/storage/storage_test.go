@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBalanceConcurrency fires withdrawals and accruals for one user in parallel and checks
+// that no points are lost or created and that the balance never goes negative.
+func TestBalanceConcurrency(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	const (
+		accruals    = 20
+		accrual     = 10
+		withdrawals = 40
+		withdrawal  = 7
+	)
+
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	login := fmt.Sprintf("stress-%d", time.Now().UnixNano())
+	err := userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx)
+	require.NoError(t, err)
+
+	numbers := luhnNumbers(accruals + withdrawals)
+	for _, number := range numbers[:accruals] {
+		err = userStorage.PutOrder(service.Order{Number: number, Login: login}, ctx)
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	withdrawn := 0
+	for _, number := range numbers[:accruals] {
+		wg.Add(1)
+		go func(number service.OrderNumber) {
+			defer wg.Done()
+			err := userStorage.UpdateOrderStatus(service.Order{
+				Number: number, Login: login, Status: PROCESSED, Accrual: accrual,
+			}, ctx)
+			assert.NoError(t, err)
+		}(number)
+	}
+	for _, number := range numbers[accruals:] {
+		wg.Add(1)
+		go func(number service.OrderNumber) {
+			defer wg.Done()
+			err := userStorage.Withdraw(service.Withdrawal{
+				Login: login, OrderID: number, Amount: withdrawal,
+			}, ctx)
+			if errors.Is(err, ErrNotEnoughPoints) {
+				return
+			}
+			if assert.NoError(t, err) {
+				mu.Lock()
+				withdrawn++
+				mu.Unlock()
+			}
+		}(number)
+	}
+	wg.Wait()
+
+	balance, err := userStorage.GetBalanceByLogin(login, ctx)
+	require.NoError(t, err)
+	withdrawnAmount, err := userStorage.GetWithdrawnAmount(login, ctx)
+	require.NoError(t, err)
+
+	assert.GreaterOrEqual(t, balance, float32(0))
+	assert.Equal(t, float32(accruals*accrual-withdrawn*withdrawal), balance)
+	assert.Equal(t, float32(withdrawn*withdrawal), withdrawnAmount)
+}
+
+func luhnNumbers(count int) []service.OrderNumber {
+	numbers := make([]service.OrderNumber, 0, count)
+	base := time.Now().UnixNano()
+	for candidate := base; len(numbers) < count; candidate++ {
+		number := fmt.Sprint(candidate)
+		if service.ValidLuhn(number) {
+			numbers = append(numbers, service.OrderNumber(number))
+		}
+	}
+	return numbers
+}
+
+// TestPutOrdersConcurrent uploads the same batch for two users at once. Every number goes to
+// exactly one of them, and the loser learns it from the batch result instead of an error.
+func TestPutOrdersConcurrent(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+	ctx := tenantContext(context.Background(), service.DefaultTenantID)
+
+	logins := []string{fmt.Sprintf("batch-a-%d", time.Now().UnixNano()), fmt.Sprintf("batch-b-%d", time.Now().UnixNano())}
+	for _, login := range logins {
+		require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+	}
+
+	numbers := luhnNumbers(50)
+	results := make([][]service.OrderUploadResult, len(logins))
+	var wg sync.WaitGroup
+	for i, login := range logins {
+		wg.Add(1)
+		go func(i int, login string) {
+			defer wg.Done()
+			var err error
+			results[i], err = userStorage.PutOrders(login, numbers, ctx)
+			assert.NoError(t, err)
+		}(i, login)
+	}
+	wg.Wait()
+
+	for i := range numbers {
+		accepted := 0
+		for _, result := range results {
+			require.Len(t, result, len(numbers))
+			if result[i].Result == UploadAccepted {
+				accepted++
+			} else {
+				assert.Equal(t, UploadedByAnotherUser, result[i].Result)
+			}
+		}
+		assert.Equal(t, 1, accepted, "number %s", numbers[i])
+	}
+}
+
+func TestStatusRegresses(t *testing.T) {
+	tests := []struct {
+		current   string
+		next      string
+		regresses bool
+	}{
+		{current: NEW, next: REGISTERED},
+		{current: REGISTERED, next: PROCESSING},
+		{current: PROCESSING, next: PROCESSING},
+		{current: PROCESSING, next: PROCESSED},
+		{current: REGISTERED, next: INVALID},
+		{current: PROCESSED, next: PROCESSED},
+		{current: PROCESSING, next: REGISTERED, regresses: true},
+		{current: REGISTERED, next: NEW, regresses: true},
+		{current: PROCESSED, next: PROCESSING, regresses: true},
+		{current: PROCESSED, next: INVALID, regresses: true},
+		{current: INVALID, next: PROCESSED, regresses: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.regresses, StatusRegresses(tt.current, tt.next), "%s after %s", tt.next, tt.current)
+	}
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+// registerTenantScope makes every statement on a model with a TenantID field work only with
+// the rows of the tenant bound to the statement context, and stamps new rows with that tenant.
+// Storage methods thus stay tenant agnostic, and a query can not reach another tenant by mistake.
+func registerTenantScope(connection *gorm.DB) error {
+	callback := connection.Callback()
+	err := callback.Create().Before("gorm:create").Register("tenant:create", stampTenant)
+	if err != nil {
+		return err
+	}
+	err = callback.Query().Before("gorm:query").Register("tenant:query", scopeTenant)
+	if err != nil {
+		return err
+	}
+	err = callback.Update().Before("gorm:update").Register("tenant:update", scopeTenant)
+	if err != nil {
+		return err
+	}
+	err = callback.Delete().Before("gorm:delete").Register("tenant:delete", scopeTenant)
+	if err != nil {
+		return err
+	}
+	return callback.Row().Before("gorm:row").Register("tenant:row", scopeTenant)
+}
+
+func tenantField(db *gorm.DB) (*schema.Field, string, bool) {
+	if db.Statement.Schema == nil {
+		return nil, "", false
+	}
+	field := db.Statement.Schema.LookUpField("TenantID")
+	if field == nil {
+		return nil, "", false
+	}
+	tenant, ok := service.TenantFromContext(db.Statement.Context)
+	return field, tenant.ID, ok
+}
+
+func scopeTenant(db *gorm.DB) {
+	field, tenantID, ok := tenantField(db)
+	if !ok {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenantID},
+	}})
+}
+
+func stampTenant(db *gorm.DB) {
+	field, tenantID, ok := tenantField(db)
+	if !ok {
+		return
+	}
+
+	stamp := func(value reflect.Value) {
+		if _, isZero := field.ValueOf(db.Statement.Context, value); isZero {
+			db.AddError(field.Set(db.Statement.Context, value, tenantID))
+		}
+	}
+	switch db.Statement.ReflectValue.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < db.Statement.ReflectValue.Len(); i++ {
+			stamp(reflect.Indirect(db.Statement.ReflectValue.Index(i)))
+		}
+	case reflect.Struct:
+		stamp(db.Statement.ReflectValue)
+	}
+}
+
+// tenantContext binds a background job context to the tenant of the row it is working on.
+func tenantContext(ctx context.Context, tenantID string) context.Context {
+	return service.ContextWithTenant(ctx, service.Tenant{ID: tenantID})
+}
+
+// requireTenant guards the methods that address a row by its order number. Tenants share
+// order numbers, so an unscoped context would let such a method reach the row of any tenant.
+func requireTenant(ctx context.Context) error {
+	if _, ok := service.TenantFromContext(ctx); !ok {
+		return ErrTenantRequired
+	}
+	return nil
+}
+
+// migrateTenants replaces the single shop keys of databases created before tenants were introduced.
+// AutoMigrate creates the tenant scoped indexes, but it neither drops constraints nor changes primary keys.
+func migrateTenants(connection *gorm.DB) error {
+	migrator := connection.Migrator()
+	for table, constraint := range map[string]string{"users": "users_login_key", "orders": "orders_number_key"} {
+		if migrator.HasConstraint(table, constraint) {
+			err := migrator.DropConstraint(table, constraint)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for table, columns := range map[string]string{
+		"withdrawals":      "tenant_id, order_id",
+		"idempotency_keys": "tenant_id, login, key",
+	} {
+		var scoped int64
+		err := connection.Raw(`SELECT count(*) FROM information_schema.key_column_usage
+			WHERE table_name = ? AND constraint_name = ? AND column_name = 'tenant_id'`, table, table+"_pkey").
+			Scan(&scoped).Error
+		if err != nil {
+			return err
+		}
+		if scoped != 0 {
+			continue
+		}
+		err = connection.Exec("ALTER TABLE " + table + " DROP CONSTRAINT IF EXISTS " + table + "_pkey, " +
+			"ADD PRIMARY KEY (" + columns + ")").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return connection.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&service.Tenant{ID: service.DefaultTenantID, Name: service.DefaultTenantID}).Error
+}
+
+func (dbStorage DBStorage) CreateTenant(tenant service.Tenant, ctx context.Context) (service.Tenant, error) {
+	err := dbStorage.db.WithContext(ctx).Save(&tenant).Error
+	if err != nil {
+		return service.Tenant{}, err
+	}
+	return tenant, nil
+}
+
+func (dbStorage DBStorage) GetTenants(ctx context.Context) ([]service.Tenant, error) {
+	var tenants []service.Tenant
+	err := dbStorage.db.WithContext(ctx).Order("id asc").Find(&tenants).Error
+	if err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+func (dbStorage DBStorage) GetTenant(id string, ctx context.Context) (service.Tenant, error) {
+	var tenant service.Tenant
+	err := dbStorage.db.WithContext(ctx).Where("id = ?", id).First(&tenant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return service.Tenant{}, ErrTenantNotFound
+	}
+	return tenant, err
+}
+
+func (dbStorage DBStorage) GetTenantByHost(host string, ctx context.Context) (service.Tenant, error) {
+	var tenant service.Tenant
+	err := dbStorage.db.WithContext(ctx).Where("host = ?", host).First(&tenant).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return service.Tenant{}, ErrTenantNotFound
+	}
+	return tenant, err
+}
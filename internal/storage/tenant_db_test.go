@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestGetOrderTenantScoped uploads the same order number to two tenants and checks that
+// each tenant gets its own order and that a context without a tenant gets none.
+func TestGetOrderTenantScoped(t *testing.T) {
+	databaseDSN := os.Getenv("DATABASE_URI")
+	if databaseDSN == "" {
+		t.Skip("DATABASE_URI is not set")
+	}
+	userStorage := NewUserStorage(databaseDSN, Settings{})
+	defer userStorage.DeleteAll()
+
+	other, err := userStorage.CreateTenant(service.Tenant{
+		ID: fmt.Sprintf("other-%d", time.Now().UnixNano()), Name: "other",
+	}, context.Background())
+	require.NoError(t, err)
+
+	number := luhnNumbers(1)[0]
+	logins := map[string]string{}
+	for _, tenantID := range []string{service.DefaultTenantID, other.ID} {
+		ctx := tenantContext(context.Background(), tenantID)
+		login := fmt.Sprintf("%s-%d", tenantID, time.Now().UnixNano())
+		require.NoError(t, userStorage.RegisterUser(service.User{Login: login, Password: "giveyouup"}, ctx))
+		require.NoError(t, userStorage.PutOrder(service.Order{Number: number, Login: login}, ctx))
+		logins[tenantID] = login
+	}
+
+	for tenantID, login := range logins {
+		order, err := userStorage.GetOrder(number, tenantContext(context.Background(), tenantID))
+		require.NoError(t, err)
+		assert.Equal(t, tenantID, order.TenantID)
+		assert.Equal(t, login, order.Login)
+	}
+
+	_, err = userStorage.GetOrder(number, context.Background())
+	assert.ErrorIs(t, err, ErrTenantRequired)
+	_, err = userStorage.ChargeBack(number, 0, INVALID, context.Background())
+	assert.ErrorIs(t, err, ErrTenantRequired)
+}
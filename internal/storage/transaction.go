@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const (
+	maxTxAttempts = 5
+	txRetryDelay  = 10 * time.Millisecond
+)
+
+// inTx runs fn in a transaction and runs it again when Postgres aborts the transaction
+// on a serialization failure or a deadlock, which is expected under concurrent balance changes.
+func (dbStorage DBStorage) inTx(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	for attempt := 1; ; attempt++ {
+		err := dbStorage.db.WithContext(ctx).Transaction(fn)
+		if err == nil || !isRetryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * txRetryDelay):
+		}
+	}
+}
+
+// isUniqueViolation reports whether a statement lost a race on a unique index.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// lockUser loads the user with SELECT ... FOR UPDATE. Every path that changes a balance locks
+// the user row before any order, withdrawal or lot row, so concurrent changes queue up
+// instead of working on a stale balance. Deleted users are locked too, their orders and lots
+// are still settled by the background jobs, so the balance updates are unscoped as well.
+func lockUser(tx *gorm.DB, login string) (service.User, error) {
+	var user service.User
+	err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where("login = ?", login).First(&user).Error
+	return user, err
+}
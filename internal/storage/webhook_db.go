@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"gophermart/internal/service"
+	"gorm.io/gorm"
+	"time"
+)
+
+// enqueueWebhooks schedules a delivery of the event to every active subscription that wants it.
+func enqueueWebhooks(tx *gorm.DB, event service.OutboxEvent) error {
+	var subscriptions []service.WebhookSubscription
+	err := tx.Where("active = ?", true).Find(&subscriptions).Error
+	if err != nil {
+		return err
+	}
+
+	for _, subscription := range subscriptions {
+		if !subscription.Wants(event.Type) {
+			continue
+		}
+		delivery := service.WebhookDelivery{
+			SubscriptionID: subscription.ID,
+			EventID:        event.ID,
+			EventType:      event.Type,
+			Payload:        event.Payload,
+			EventCreatedAt: event.CreatedAt,
+			Status:         WebhookPending,
+			NextAttemptAt:  time.Now(),
+		}
+		err = tx.Create(&delivery).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbStorage DBStorage) CreateWebhook(subscription service.WebhookSubscription, ctx context.Context) (service.WebhookSubscription, error) {
+	subscription.Active = true
+	err := dbStorage.db.WithContext(ctx).Create(&subscription).Error
+	return subscription, err
+}
+
+func (dbStorage DBStorage) GetWebhooks(ctx context.Context) ([]service.WebhookSubscription, error) {
+	var subscriptions []service.WebhookSubscription
+	err := dbStorage.db.WithContext(ctx).Where("active = ?", true).Order("id asc").Find(&subscriptions).Error
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteWebhook deactivates the subscription, its delivery log is kept.
+func (dbStorage DBStorage) DeleteWebhook(id uint, ctx context.Context) error {
+	result := dbStorage.db.WithContext(ctx).Model(&service.WebhookSubscription{}).
+		Where("id = ? AND active = ?", id, true).Update("active", false)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (dbStorage DBStorage) GetDueWebhookDeliveries(now time.Time, limit int, ctx context.Context) ([]service.WebhookDelivery, error) {
+	var deliveries []service.WebhookDelivery
+	err := dbStorage.db.WithContext(ctx).Preload("Subscription").
+		Where("status = ? AND next_attempt_at <= ?", WebhookPending, now).
+		Order("id asc").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt saves the new state of the delivery together with its log entry.
+func (dbStorage DBStorage) RecordWebhookAttempt(delivery service.WebhookDelivery, attempt service.WebhookAttempt, ctx context.Context) error {
+	return dbStorage.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&delivery).
+			Select("status", "attempts", "next_attempt_at", "last_error", "delivered_at").
+			Updates(&delivery).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&attempt).Error
+	})
+}
+
+func (dbStorage DBStorage) GetWebhookAttempts(subscriptionID uint, limit int, ctx context.Context) ([]service.WebhookAttempt, error) {
+	var attempts []service.WebhookAttempt
+	err := dbStorage.db.WithContext(ctx).Where("subscription_id = ?", subscriptionID).
+		Order("id desc").Limit(limit).Find(&attempts).Error
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+func (dbStorage DBStorage) GetDeadWebhookDeliveries(ctx context.Context) ([]service.WebhookDelivery, error) {
+	var deliveries []service.WebhookDelivery
+	err := dbStorage.db.WithContext(ctx).Where("status = ?", WebhookDead).Order("id asc").Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RetryWebhookDelivery puts a dead delivery back into the queue with a fresh retry budget.
+func (dbStorage DBStorage) RetryWebhookDelivery(id uint, ctx context.Context) error {
+	result := dbStorage.db.WithContext(ctx).Model(&service.WebhookDelivery{}).
+		Where("id = ? AND status = ?", id, WebhookDead).
+		Updates(map[string]interface{}{
+			"status":          WebhookPending,
+			"attempts":        0,
+			"next_attempt_at": time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
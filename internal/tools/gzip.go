@@ -1,7 +1,6 @@
 package tools
 
 import (
-	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -18,6 +17,16 @@ func (gzipWriter gzipWriter) Write(b []byte) (int, error) {
 	return gzipWriter.Writer.Write(b)
 }
 
+// Flush pushes the compressed data written so far to the client, streaming handlers rely on it.
+func (gzipWriter gzipWriter) Flush() {
+	if flusher, ok := gzipWriter.Writer.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := gzipWriter.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func GzipMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
 
@@ -37,14 +46,11 @@ func GzipMiddleware(next http.Handler) http.Handler {
 				_ = gzipReader.Close()
 			}()
 
-			body, err := io.ReadAll(gzipReader)
-			if err != nil {
-				http.Error(writer, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			request.Body = io.NopCloser(bytes.NewReader(body))
-			request.ContentLength = int64(len(body))
+			// the body is decompressed as it is read, so the body limits of the routes apply to the
+			// decompressed size and a small compressed request can not blow up in memory
+			request.Body = gzipReader
+			request.ContentLength = -1
+			request.Header.Del("Content-Length")
 		}
 
 		gzipReader, err := gzip.NewWriterLevel(writer, gzip.BestSpeed)
@@ -0,0 +1,27 @@
+package tools
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SecurityHeaders sets the headers that keep browsers from sniffing, framing or embedding the
+// API responses. HSTS is only sent over HTTPS, directly or behind a TLS terminating proxy,
+// and is disabled by a zero max age.
+func SecurityHeaders(hstsMaxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			header := writer.Header()
+			header.Set("X-Content-Type-Options", "nosniff")
+			header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+			header.Set("X-Frame-Options", "DENY")
+			header.Set("Referrer-Policy", "no-referrer")
+			if hstsMaxAge > 0 && (request.TLS != nil || request.Header.Get("X-Forwarded-Proto") == "https") {
+				header.Set("Strict-Transport-Security",
+					fmt.Sprintf("max-age=%d; includeSubDomains", int64(hstsMaxAge/time.Second)))
+			}
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
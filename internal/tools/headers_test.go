@@ -0,0 +1,54 @@
+package tools
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	handler := SecurityHeaders(24 * time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		hsts    string
+	}{
+		{
+			name:    "plain http",
+			request: func() *http.Request { return httptest.NewRequest(http.MethodGet, "/api/user/orders", nil) },
+		},
+		{
+			name: "tls",
+			request: func() *http.Request {
+				request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+				request.TLS = &tls.ConnectionState{}
+				return request
+			},
+			hsts: "max-age=86400; includeSubDomains",
+		},
+		{
+			name: "tls terminating proxy",
+			request: func() *http.Request {
+				request := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+				request.Header.Set("X-Forwarded-Proto", "https")
+				return request
+			},
+			hsts: "max-age=86400; includeSubDomains",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, tt.request())
+
+			assert.Equal(t, "nosniff", recorder.Header().Get("X-Content-Type-Options"))
+			assert.Equal(t, "default-src 'none'; frame-ancestors 'none'", recorder.Header().Get("Content-Security-Policy"))
+			assert.Equal(t, "DENY", recorder.Header().Get("X-Frame-Options"))
+			assert.Equal(t, tt.hsts, recorder.Header().Get("Strict-Transport-Security"))
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package tools
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves the certificate of a cert and key file pair and loads it again after the
+// files change, so that a renewed certificate is picked up without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	modTime     time.Time
+	checkedAt   time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	err = reloader.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate is meant for tls.Config. A certificate that fails to load is logged
+// and the previous one is served until the files are fixed.
+func (reloader *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if time.Since(reloader.checkedAt) < certCheckInterval {
+		return reloader.certificate, nil
+	}
+	reloader.checkedAt = time.Now()
+
+	modTime, err := reloader.filesModTime()
+	if err != nil {
+		log.Printf("tls: check certificate: %s", err)
+		return reloader.certificate, nil
+	}
+	if modTime.Equal(reloader.modTime) {
+		return reloader.certificate, nil
+	}
+	err = reloader.load(modTime)
+	if err != nil {
+		log.Printf("tls: reload certificate: %s", err)
+		return reloader.certificate, nil
+	}
+	log.Printf("tls: certificate %s reloaded", reloader.certFile)
+	return reloader.certificate, nil
+}
+
+func (reloader *CertReloader) load(modTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+	reloader.certificate = &certificate
+	reloader.modTime = modTime
+	reloader.checkedAt = time.Now()
+	return nil
+}
+
+// filesModTime is the latest modification time of the pair, a renewal may rewrite either file first.
+func (reloader *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"gophermart/internal/outbox"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DeliveryStorage is the part of storage.UserStorage the dispatcher works with.
+type DeliveryStorage interface {
+	GetDueWebhookDeliveries(now time.Time, limit int, ctx context.Context) ([]service.WebhookDelivery, error)
+	RecordWebhookAttempt(delivery service.WebhookDelivery, attempt service.WebhookAttempt, ctx context.Context) error
+}
+
+type Settings struct {
+	Timeout     time.Duration
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	BatchSize   int
+}
+
+// Dispatcher sends pending webhook deliveries. A failed delivery is retried with exponential
+// backoff and ends up in the dead letter list once its attempts are used up.
+type Dispatcher struct {
+	storage  DeliveryStorage
+	client   *resty.Client
+	settings Settings
+}
+
+func NewDispatcher(storage DeliveryStorage, settings Settings) *Dispatcher {
+	return &Dispatcher{
+		storage:  storage,
+		client:   resty.New().SetTimeout(settings.Timeout),
+		settings: settings,
+	}
+}
+
+func (dispatcher *Dispatcher) Dispatch(ctx context.Context) error {
+	deliveries, err := dispatcher.storage.GetDueWebhookDeliveries(time.Now(), dispatcher.settings.BatchSize, ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		attempt := dispatcher.deliver(ctx, delivery)
+		delivery.Attempts++
+		switch {
+		case attempt.Error == "":
+			delivery.Status = storage.WebhookDelivered
+			delivery.DeliveredAt = &attempt.AttemptedAt
+			delivery.LastError = ""
+		case !delivery.Subscription.Active || delivery.Attempts >= dispatcher.settings.MaxAttempts:
+			delivery.Status = storage.WebhookDead
+			delivery.LastError = attempt.Error
+		default:
+			delivery.NextAttemptAt = time.Now().Add(dispatcher.backoff(delivery.Attempts))
+			delivery.LastError = attempt.Error
+		}
+
+		err = dispatcher.storage.RecordWebhookAttempt(delivery, attempt, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dispatcher *Dispatcher) deliver(ctx context.Context, delivery service.WebhookDelivery) service.WebhookAttempt {
+	attempt := service.WebhookAttempt{
+		DeliveryID:     delivery.ID,
+		SubscriptionID: delivery.SubscriptionID,
+		EventType:      delivery.EventType,
+		AttemptedAt:    time.Now(),
+	}
+	if !delivery.Subscription.Active {
+		attempt.Error = "subscription is deleted"
+		return attempt
+	}
+
+	body, err := outbox.Marshal(service.OutboxEvent{
+		ID:        delivery.EventID,
+		TenantID:  delivery.Subscription.TenantID,
+		Type:      delivery.EventType,
+		Payload:   delivery.Payload,
+		CreatedAt: delivery.EventCreatedAt,
+	})
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := strconv.FormatInt(attempt.AttemptedAt.Unix(), 10)
+	resp, err := dispatcher.client.R().SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader("X-Gophermart-Event", delivery.EventType).
+		SetHeader("X-Gophermart-Delivery", strconv.FormatUint(uint64(delivery.ID), 10)).
+		SetHeader("X-Gophermart-Timestamp", timestamp).
+		SetHeader("X-Gophermart-Signature", "sha256="+Sign(delivery.Subscription.Secret, timestamp, body)).
+		SetBody(body).
+		Post(delivery.Subscription.URL)
+	attempt.Duration = time.Since(attempt.AttemptedAt).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	attempt.ResponseCode = resp.StatusCode()
+	if resp.IsError() {
+		attempt.Error = fmt.Sprintf("endpoint responded with %s", resp.Status())
+	}
+	log.Printf("webhook delivery %d to %s: %d", delivery.ID, delivery.Subscription.URL, attempt.ResponseCode)
+	return attempt
+}
+
+func (dispatcher *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := dispatcher.settings.Backoff
+	for i := 1; i < attempts && backoff < dispatcher.settings.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > dispatcher.settings.MaxBackoff {
+		backoff = dispatcher.settings.MaxBackoff
+	}
+	return backoff
+}
+
+// Sign is the HMAC-SHA256 of "<timestamp>.<body>" with the subscription secret,
+// receivers recompute it to check that a delivery is authentic and fresh.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gophermart/internal/service"
+	"gophermart/internal/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type memoryStorage struct {
+	deliveries []service.WebhookDelivery
+	attempts   []service.WebhookAttempt
+}
+
+func (memory *memoryStorage) GetDueWebhookDeliveries(now time.Time, _ int, _ context.Context) ([]service.WebhookDelivery, error) {
+	var due []service.WebhookDelivery
+	for _, delivery := range memory.deliveries {
+		if delivery.Status == storage.WebhookPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	return due, nil
+}
+
+func (memory *memoryStorage) RecordWebhookAttempt(delivery service.WebhookDelivery, attempt service.WebhookAttempt, _ context.Context) error {
+	for i := range memory.deliveries {
+		if memory.deliveries[i].ID == delivery.ID {
+			memory.deliveries[i] = delivery
+		}
+	}
+	memory.attempts = append(memory.attempts, attempt)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		signature := "sha256=" + Sign("rickroll", r.Header.Get("X-Gophermart-Timestamp"), body)
+		assert.Equal(t, signature, r.Header.Get("X-Gophermart-Signature"))
+		assert.Equal(t, service.EventPointsWithdrawn, r.Header.Get("X-Gophermart-Event"))
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	subscription := service.WebhookSubscription{ID: 1, URL: server.URL, Secret: "rickroll", Active: true}
+	memory := &memoryStorage{deliveries: []service.WebhookDelivery{
+		{
+			ID:             1,
+			SubscriptionID: 1,
+			Subscription:   subscription,
+			EventID:        7,
+			EventType:      service.EventPointsWithdrawn,
+			Payload:        `{"login":"nevergonna","order":"2377225624","sum":5}`,
+			Status:         storage.WebhookPending,
+		},
+	}}
+	dispatcher := NewDispatcher(memory, Settings{
+		Timeout:     time.Second,
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		BatchSize:   10,
+	})
+
+	err := dispatcher.Dispatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, storage.WebhookPending, memory.deliveries[0].Status)
+	assert.Equal(t, http.StatusServiceUnavailable, memory.attempts[0].ResponseCode)
+
+	time.Sleep(2 * time.Millisecond)
+	err = dispatcher.Dispatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, storage.WebhookDelivered, memory.deliveries[0].Status)
+	assert.Equal(t, 2, memory.deliveries[0].Attempts)
+	assert.Len(t, memory.attempts, 2)
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	memory := &memoryStorage{deliveries: []service.WebhookDelivery{
+		{
+			ID:           1,
+			Subscription: service.WebhookSubscription{URL: server.URL, Active: true},
+			EventType:    service.EventOrderStatusChanged,
+			Payload:      `{}`,
+			Status:       storage.WebhookPending,
+		},
+	}}
+	dispatcher := NewDispatcher(memory, Settings{Timeout: time.Second, MaxAttempts: 1, BatchSize: 10})
+
+	err := dispatcher.Dispatch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, storage.WebhookDead, memory.deliveries[0].Status)
+	assert.NotEmpty(t, memory.deliveries[0].LastError)
+}